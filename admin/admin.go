@@ -0,0 +1,247 @@
+// Package admin serves an HTTP API for changing the rules of a
+// running dnsmock, e.g. to flip answers in the middle of a test.
+//
+//	GET    /rules          list the rules, as YAML
+//	POST   /rules          add a rule after the others
+//	GET    /rules/{name}   list the rules for a name
+//	PUT    /rules/{name}   replace the rules for a name with one rule
+//	DELETE /rules/{name}   remove the rules for a name
+//	GET    /spec           the whole spec, as a replay file
+//	PUT    /spec           replace the whole spec
+//	POST   /reset          reset the state of the rules, e.g. sequences
+//	GET    /metrics        the metrics, if served on the same address
+//
+// Request bodies are YAML, or JSON, in the replay file format.
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/shawnburke/dnsmock/config"
+	"github.com/shawnburke/dnsmock/httpserver"
+	"github.com/shawnburke/dnsmock/metrics"
+	"github.com/shawnburke/dnsmock/spec"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// maxBodySize is the largest request body accepted
+const maxBodySize = 10 << 20
+
+// Server is the admin HTTP server
+type Server interface {
+	httpserver.Server
+}
+
+type server struct {
+	httpserver.Server
+	logger    *zap.Logger
+	responses *spec.Responses
+	// gatherer is served at /metrics, if set
+	gatherer prometheus.Gatherer
+}
+
+// Option configures optional admin server behavior
+type Option func(s *server)
+
+// WithMetrics serves the metrics in gatherer at /metrics too,
+// for when they share the admin server's address
+func WithMetrics(gatherer prometheus.Gatherer) Option {
+	return func(s *server) {
+		s.gatherer = gatherer
+	}
+}
+
+// New creates an admin server for the rules in responses
+func New(addr string, responses *spec.Responses, logger *zap.Logger, opts ...Option) Server {
+	s := &server{
+		logger:    logger.With(zap.String("component", "admin")),
+		responses: responses,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.Server = httpserver.New("admin", addr, s.handler(), logger)
+	return s
+}
+
+// NewFromConfig creates the admin server if an address is configured, nil
+// otherwise.  If metrics have the same address, it serves those too.
+func NewFromConfig(cfg config.Parameters, responses *spec.Responses, registry *prometheus.Registry, logger *zap.Logger) Server {
+	if cfg.AdminAddr == "" {
+		return nil
+	}
+	opts := []Option{}
+	if cfg.MetricsOnAdmin() {
+		opts = append(opts, WithMetrics(registry))
+	}
+	return New(cfg.AdminAddr, responses, logger, opts...)
+}
+
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rules", s.rules)
+	mux.HandleFunc("/rules/", s.rule)
+	mux.HandleFunc("/spec", s.spec)
+	mux.HandleFunc("/reset", s.reset)
+	if s.gatherer != nil {
+		mux.Handle("/metrics", metrics.Handler(s.gatherer))
+	}
+	return mux
+}
+
+func (s *server) rules(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		s.writeRules(w, "")
+	case http.MethodPost:
+		rule, ok := s.readRule(w, req)
+		if !ok {
+			return
+		}
+		if err := s.responses.AddRule(rule); err != nil {
+			s.fail(w, http.StatusBadRequest, err)
+			return
+		}
+		s.logger.Info("Added rule", zap.String("name", rule.Name))
+		w.WriteHeader(http.StatusCreated)
+	default:
+		notAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+func (s *server) rule(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, "/rules/")
+	if name == "" {
+		s.fail(w, http.StatusNotFound, errors.New("missing rule name"))
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		s.writeRules(w, name)
+	case http.MethodPut:
+		rule, ok := s.readRule(w, req)
+		if !ok {
+			return
+		}
+		if rule.Name == "" {
+			rule.Name = name
+		}
+		if err := s.responses.ReplaceRule(name, rule); err != nil {
+			s.fail(w, http.StatusBadRequest, err)
+			return
+		}
+		s.logger.Info("Replaced rule", zap.String("name", name))
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		removed, err := s.responses.RemoveRule(name)
+		if err != nil {
+			s.fail(w, http.StatusInternalServerError, err)
+			return
+		}
+		if removed == 0 {
+			s.fail(w, http.StatusNotFound, fmt.Errorf("no rule for %q", name))
+			return
+		}
+		s.logger.Info("Removed rule", zap.String("name", name), zap.Int("count", removed))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		notAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+	}
+}
+
+func (s *server) spec(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		y, err := s.responses.YAML()
+		if err != nil {
+			s.fail(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeYAML(w, y)
+	case http.MethodPut:
+		body, ok := s.readBody(w, req)
+		if !ok {
+			return
+		}
+		parsed, err := spec.FromYAML(string(body))
+		if err == nil {
+			err = s.responses.SetRules(parsed.Rules)
+		}
+		if err != nil {
+			s.fail(w, http.StatusBadRequest, err)
+			return
+		}
+		s.logger.Info("Replaced spec", zap.Int("rules", len(parsed.Rules)))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		notAllowed(w, http.MethodGet, http.MethodPut)
+	}
+}
+
+func (s *server) reset(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		notAllowed(w, http.MethodPost)
+		return
+	}
+	s.responses.Reset()
+	s.logger.Info("Reset rules")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) writeRules(w http.ResponseWriter, name string) {
+	y, count, err := s.responses.RulesYAML(name)
+	if err != nil {
+		s.fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	if name != "" && count == 0 {
+		s.fail(w, http.StatusNotFound, fmt.Errorf("no rule for %q", name))
+		return
+	}
+	writeYAML(w, y)
+}
+
+func (s *server) readBody(w http.ResponseWriter, req *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxBodySize))
+	if err != nil {
+		s.fail(w, http.StatusBadRequest, err)
+		return nil, false
+	}
+	return body, true
+}
+
+func (s *server) readRule(w http.ResponseWriter, req *http.Request) (*spec.Rule, bool) {
+	body, ok := s.readBody(w, req)
+	if !ok {
+		return nil, false
+	}
+
+	rule := &spec.Rule{}
+	if err := yaml.Unmarshal(body, rule); err != nil {
+		s.fail(w, http.StatusBadRequest, err)
+		return nil, false
+	}
+	return rule, true
+}
+
+func (s *server) fail(w http.ResponseWriter, status int, err error) {
+	s.logger.Debug("Admin request failed", zap.Int("status", status), zap.Error(err))
+	http.Error(w, err.Error(), status)
+}
+
+func writeYAML(w http.ResponseWriter, y string) {
+	w.Header().Set("Content-Type", "application/yaml")
+	io.WriteString(w, y)
+}
+
+func notAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,142 @@
+package admin
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/shawnburke/dnsmock/config"
+	"github.com/shawnburke/dnsmock/metrics"
+	"github.com/shawnburke/dnsmock/spec"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+const specYaml = `
+rules:
+  - name: "api.test."
+    records:
+      A: ["api.test. 60 IN A 10.0.0.1"]
+  - name: "db.test."
+    records:
+      A: ["db.test. 60 IN A 10.0.0.2"]
+`
+
+func TestAdmin(t *testing.T) {
+	s, err := spec.FromYAML(specYaml)
+	require.NoError(t, err)
+
+	a := New("127.0.0.1:0", s, zap.NewNop())
+	require.NoError(t, a.Start())
+	defer a.Stop()
+
+	do := func(method string, path string, body string) (int, string) {
+		req, err := http.NewRequest(method, "http://"+a.Addr()+path, strings.NewReader(body))
+		require.NoError(t, err)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		out, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res.StatusCode, string(out)
+	}
+
+	answer := func(name string) string {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		res, err := s.Find(msg)
+		require.NoError(t, err)
+		if res == nil || len(res.Answer) == 0 {
+			return ""
+		}
+		return res.Answer[0].(*dns.A).A.String()
+	}
+
+	status, body := do(http.MethodGet, "/rules", "")
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, body, "api.test.")
+	require.Contains(t, body, "db.test.")
+
+	status, body = do(http.MethodGet, "/rules/db.test.", "")
+	require.Equal(t, http.StatusOK, status)
+	require.NotContains(t, body, "api.test.")
+
+	status, _ = do(http.MethodGet, "/rules/nope.test.", "")
+	require.Equal(t, http.StatusNotFound, status)
+
+	// JSON works as well as YAML
+	status, _ = do(http.MethodPost, "/rules", `{"name": "new.test.", "records": {"A": ["new.test. 60 IN A 10.0.0.3"]}}`)
+	require.Equal(t, http.StatusCreated, status)
+	require.Equal(t, "10.0.0.3", answer("new.test."))
+
+	status, _ = do(http.MethodPut, "/rules/api.test.", "records:\n  A: [\"api.test. 60 IN A 10.9.9.9\"]\n")
+	require.Equal(t, http.StatusNoContent, status)
+	require.Equal(t, "10.9.9.9", answer("api.test."))
+	require.Equal(t, "api.test.", s.Rules[0].Name)
+
+	status, body = do(http.MethodPut, "/rules/api.test.", "records:\n  A: [\"api.test. IN A nope\"]\n")
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Contains(t, body, `rule "api.test." A (line 2)`)
+	require.Equal(t, "10.9.9.9", answer("api.test."))
+
+	status, _ = do(http.MethodDelete, "/rules/db.test.", "")
+	require.Equal(t, http.StatusNoContent, status)
+	require.Equal(t, "", answer("db.test."))
+	status, _ = do(http.MethodDelete, "/rules/db.test.", "")
+	require.Equal(t, http.StatusNotFound, status)
+
+	status, body = do(http.MethodGet, "/spec", "")
+	require.Equal(t, http.StatusOK, status)
+	require.True(t, strings.HasPrefix(body, "rules:"), body)
+
+	status, _ = do(http.MethodPut, "/spec", specYaml)
+	require.Equal(t, http.StatusNoContent, status)
+	require.Equal(t, "10.0.0.2", answer("db.test."))
+	require.Equal(t, "", answer("new.test."))
+
+	status, _ = do(http.MethodPut, "/spec", "rules: [{}]")
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Len(t, s.Rules, 2)
+
+	status, _ = do(http.MethodPost, "/reset", "")
+	require.Equal(t, http.StatusNoContent, status)
+
+	status, _ = do(http.MethodGet, "/reset", "")
+	require.Equal(t, http.StatusMethodNotAllowed, status)
+
+	require.NoError(t, a.Stop())
+	_, err = http.Get("http://" + a.Addr() + "/rules")
+	require.Error(t, err)
+}
+
+func TestAdminMetrics(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.New(registry).RecorderEntries.Inc()
+
+	for _, c := range []struct {
+		name   string
+		cfg    config.Parameters
+		status int
+	}{
+		{"shared", config.Parameters{AdminAddr: "127.0.0.1:0", MetricsAddr: "127.0.0.1:0"}, http.StatusOK},
+		{"separate", config.Parameters{AdminAddr: "127.0.0.1:0", MetricsAddr: "127.0.0.1:9153"}, http.StatusNotFound},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			a := NewFromConfig(c.cfg, spec.New(), registry, zap.NewNop())
+			require.NoError(t, a.Start())
+			defer a.Stop()
+
+			res, err := http.Get("http://" + a.Addr() + "/metrics")
+			require.NoError(t, err)
+			defer res.Body.Close()
+			body, err := io.ReadAll(res.Body)
+			require.NoError(t, err)
+			require.Equal(t, c.status, res.StatusCode)
+			if c.status == http.StatusOK {
+				require.Contains(t, string(body), "dnsmock_recorder_entries_total 1\n")
+			}
+		})
+	}
+}
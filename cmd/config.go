@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"strings"
+
+	"github.com/shawnburke/dnsmock/config"
+	"github.com/shawnburke/dnsmock/resolver"
+)
+
+const defaultPort = 53
+
+// configEnv names the environment variable that can point at a config file
+const configEnv = config.EnvPrefix + "CONFIG"
+
+func defaultConfig() config.Parameters {
+	return config.Parameters{
+		Port:           defaultPort,
+		DownstreamsRaw: resolver.DownstreamLocalhost,
+	}
+}
+
+// newFlagSet binds flags to cfg, using its current values as the defaults
+func newFlagSet(cfg *config.Parameters, configFile *string) *flag.FlagSet {
+	fs := flag.NewFlagSet("dnsmock", flag.ContinueOnError)
+
+	fs.StringVar(configFile, "config", *configFile, "Load parameters from a YAML or JSON file")
+	fs.BoolVar(&cfg.Verbose, "v", cfg.Verbose, "Verbose logging")
+	fs.BoolVar(&cfg.Record, "record", cfg.Record, "Record responses")
+	fs.StringVar(&cfg.ReplayFile, "replay-file", cfg.ReplayFile, "Replay from file")
+	fs.StringVar(&cfg.RecordFile, "record-file", cfg.RecordFile, "Record to file")
+	fs.IntVar(&cfg.Port, "port", cfg.Port, "Listen port")
+	fs.StringVar(&cfg.DownstreamsRaw, "downstreams", cfg.DownstreamsRaw, "Downstreams, comma separated or 'none' to prevent downstream lookup, use suffix=server to route a domain to its own server")
+	fs.IntVar(&cfg.CacheSize, "cache-size", cfg.CacheSize, "Cache up to this many downstream answers, 0 to disable")
+	fs.StringVar(&cfg.AdminAddr, "admin-addr", cfg.AdminAddr, "Serve the admin HTTP API on this address, e.g. :8053")
+	fs.StringVar(&cfg.MetricsAddr, "metrics-addr", cfg.MetricsAddr, "Serve Prometheus metrics at /metrics on this address, e.g. :9153")
+	fs.StringVar(&cfg.QueryLog, "query-log", cfg.QueryLog, "Log queries as JSON lines to this file, or - for stdout")
+	fs.IntVar(&cfg.QueryLogMaxSizeMB, "query-log-max-size-mb", cfg.QueryLogMaxSizeMB, "Rotate the query log at this size, 0 to never rotate")
+	fs.IntVar(&cfg.QueryLogMaxBackups, "query-log-max-backups", cfg.QueryLogMaxBackups, "Number of rotated query logs to keep")
+	fs.BoolVar(&cfg.Strict, "strict", cfg.Strict, "Answer only from the replay file, refusing and reporting any other query")
+	fs.IntVar(&cfg.StrictExitCode, "strict-exit-code", cfg.StrictExitCode, "Exit with this code if strict mode saw unexpected queries, 0 to only report them")
+	fs.Var(&cfg.Unmatched, "unmatched", "Answer for unmatched queries: nodata (default), nxdomain, servfail or refused")
+	return fs
+}
+
+// parseConfig builds the parameters from, in increasing precedence, the
+// defaults, the config file, DNSMOCK_* environment variables and flags.
+func parseConfig(args []string, environ []string, output io.Writer) (config.Parameters, error) {
+	cfg := defaultConfig()
+
+	// first pass is just to find the config file
+	configFile := ""
+	for _, kv := range environ {
+		if strings.HasPrefix(kv, configEnv+"=") {
+			configFile = strings.TrimPrefix(kv, configEnv+"=")
+		}
+	}
+
+	probe := defaultConfig()
+	fs := newFlagSet(&probe, &configFile)
+	fs.SetOutput(output)
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if configFile != "" {
+		if err := cfg.LoadFile(configFile); err != nil {
+			return cfg, err
+		}
+	}
+
+	if err := cfg.LoadEnv(environ); err != nil {
+		return cfg, err
+	}
+
+	// now only the flags given on the command line override
+	fs = newFlagSet(&cfg, &configFile)
+	fs.SetOutput(output)
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	return cfg, cfg.Validate()
+}
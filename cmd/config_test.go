@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/shawnburke/dnsmock/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConfigPrecedence(t *testing.T) {
+	file := path.Join(t.TempDir(), "dnsmock.yaml")
+	err := os.WriteFile(file, []byte("port: 1053\ndownstreams: 1.1.1.1\nrecord: true\ncache_size: 10\n"), 0644)
+	require.NoError(t, err)
+
+	cfg, err := parseConfig(nil, nil, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, defaultConfig(), cfg)
+
+	// file over defaults
+	cfg, err = parseConfig([]string{"-config", file}, nil, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, 1053, cfg.Port)
+	require.Equal(t, "1.1.1.1", cfg.DownstreamsRaw)
+
+	// env over file
+	env := []string{configEnv + "=" + file, "DNSMOCK_PORT=2053", "DNSMOCK_UNMATCHED=servfail"}
+	cfg, err = parseConfig(nil, env, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, 2053, cfg.Port)
+	require.Equal(t, "1.1.1.1", cfg.DownstreamsRaw)
+	require.Equal(t, config.UnmatchedServFail, cfg.Unmatched)
+
+	// flags over everything, but only those given
+	cfg, err = parseConfig([]string{"-port", "3053", "-record=false"}, env, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, config.Parameters{
+		Port:           3053,
+		DownstreamsRaw: "1.1.1.1",
+		CacheSize:      10,
+		Unmatched:      config.UnmatchedServFail,
+	}, cfg)
+}
+
+func TestParseConfigInvalid(t *testing.T) {
+	_, err := parseConfig([]string{"-port", "99999"}, nil, io.Discard)
+	require.ErrorContains(t, err, "port")
+
+	_, err = parseConfig([]string{"-unmatched", "bogus"}, nil, io.Discard)
+	require.Error(t, err)
+
+	_, err = parseConfig([]string{"-config", "/does/not/exist.yaml"}, nil, io.Discard)
+	require.Error(t, err)
+}
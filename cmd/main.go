@@ -2,13 +2,17 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"io"
 	"os"
 
-	"flag"
-
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/shawnburke/dnsmock"
+	"github.com/shawnburke/dnsmock/admin"
 	"github.com/shawnburke/dnsmock/config"
+	"github.com/shawnburke/dnsmock/metrics"
+	"github.com/shawnburke/dnsmock/querylog"
 	"github.com/shawnburke/dnsmock/resolver"
 	"github.com/shawnburke/dnsmock/spec"
 	"go.uber.org/fx"
@@ -16,32 +20,48 @@ import (
 	"go.uber.org/zap"
 )
 
-const defaultPort = 53
-
 func main() {
 
-	cfg := config.Parameters{
-		Port:           defaultPort,
-		DownstreamsRaw: "",
+	if len(os.Args) > 1 && os.Args[1] == "zone" {
+		err := runZone(os.Args[2:], os.Stdout, os.Stderr)
+		if err == flag.ErrHelp {
+			os.Exit(0)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		return
 	}
 
-	flag.BoolVar(&cfg.Verbose, "v", false, "Verbose logging")
-	flag.BoolVar(&cfg.Record, "record", false, "Record responses")
-	flag.StringVar(&cfg.ReplayFile, "replay-file", "", "Replay from file")
-	flag.StringVar(&cfg.RecordFile, "record-file", "", "Record to file")
-	flag.IntVar(&cfg.Port, "port", defaultPort, "Listen port")
-	flag.StringVar(&cfg.DownstreamsRaw, "downstreams", resolver.DownstreamLocalhost, "Downstreams, comma separated or 'none' to prevent downstream lookup")
-
-	flag.Parse()
+	cfg, err := parseConfig(os.Args[1:], os.Environ(), os.Stderr)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
 	logger, err := buildLogger(cfg)
 	if err != nil {
 		panic(err)
 	}
 
-	graph := buildGraph(cfg, logger, func(ctx context.Context, s *spec.Responses) {
+	exitCode := 0
+	graph := buildGraph(cfg, logger, func(ctx context.Context, s *spec.Responses, r resolver.Resolver) {
+		if strict, ok := r.(*resolver.Strict); ok {
+			if reportUnexpected(os.Stderr, strict.Unexpected()) {
+				exitCode = cfg.StrictExitCode
+			}
+		}
+
 		if cfg.Record {
-			result := s.YAML()
+			result, err := s.YAML()
+			if err != nil {
+				fmt.Printf("Error serializing recorded responses: %v", err)
+				return
+			}
 
 			if cfg.RecordFile != "" {
 				err := os.WriteFile(cfg.RecordFile, []byte(result), 0644)
@@ -58,6 +78,22 @@ func main() {
 		return &fxevent.ZapLogger{Logger: logger}
 	}), graph).Run()
 
+	if exitCode != 0 {
+		os.Exit(exitCode)
+	}
+}
+
+// reportUnexpected writes the queries strict mode didn't expect,
+// returning whether there were any
+func reportUnexpected(w io.Writer, unexpected []resolver.UnexpectedQuery) bool {
+	if len(unexpected) == 0 {
+		return false
+	}
+	fmt.Fprintf(w, "%d unexpected queries:\n", len(unexpected))
+	for _, u := range unexpected {
+		fmt.Fprintf(w, "  %s\n", u)
+	}
+	return true
 }
 
 func buildLogger(cfg config.Parameters) (*zap.Logger, error) {
@@ -69,30 +105,50 @@ func buildLogger(cfg config.Parameters) (*zap.Logger, error) {
 	return zapcfg.Build()
 }
 
-func buildSpecResponses(cfg config.Parameters) *spec.Responses {
+func buildSpecResponses(cfg config.Parameters) (*spec.Responses, error) {
 	if cfg.ReplayFile != "" {
 		return spec.FromFile(cfg.ReplayFile)
 	}
 
-	if cfg.Record || cfg.RecordFile != "" {
-		return spec.New()
+	if cfg.Record || cfg.RecordFile != "" || cfg.AdminAddr != "" || cfg.Strict {
+		return spec.New(), nil
 	}
-	return nil
+	return nil, nil
 }
 
 func buildGraph(cfg config.Parameters,
 	logger *zap.Logger,
-	shutdown func(ctx context.Context, s *spec.Responses)) fx.Option {
+	shutdown func(ctx context.Context, s *spec.Responses, r resolver.Resolver)) fx.Option {
 	return fx.Options(
 		fx.Supply(logger),
 		fx.Supply(cfg),
 		fx.Provide(
 			buildSpecResponses,
+			metrics.NewRegistry,
+			func(registry *prometheus.Registry) *metrics.Metrics {
+				return metrics.New(registry)
+			},
 			resolver.Build,
-			dnsmock.NewFromConfig,
+			querylog.NewFromConfig,
+			func(cfg config.Parameters, r resolver.Resolver, logger *zap.Logger, l *querylog.Log, m *metrics.Metrics) dnsmock.Proxy {
+				return dnsmock.NewFromConfig(cfg, r, logger, dnsmock.WithQueryLog(l), dnsmock.WithMetrics(m))
+			},
+			admin.NewFromConfig,
+			metrics.NewServerFromConfig,
 		),
 		fx.Invoke(
-			func(lc fx.Lifecycle, p dnsmock.Proxy, s *spec.Responses, cfg config.Parameters, logger *zap.Logger) {
+			// closed after the proxy stops, as hooks stop in reverse
+			func(lc fx.Lifecycle, l *querylog.Log) {
+				if l == nil {
+					return
+				}
+				lc.Append(fx.Hook{
+					OnStop: func(ctx context.Context) error {
+						return l.Close()
+					},
+				})
+			},
+			func(lc fx.Lifecycle, p dnsmock.Proxy, s *spec.Responses, r resolver.Resolver, cfg config.Parameters, logger *zap.Logger) {
 				lc.Append(fx.Hook{
 					OnStart: func(ctx context.Context) error {
 						logger.Info("Config", zap.Any("cfg", cfg))
@@ -100,12 +156,38 @@ func buildGraph(cfg config.Parameters,
 					},
 					OnStop: func(ctx context.Context) error {
 						if shutdown != nil {
-							shutdown(ctx, s)
+							shutdown(ctx, s, r)
 						}
 						return p.Stop()
 					},
 				})
 			},
+			func(lc fx.Lifecycle, a admin.Server) {
+				if a == nil {
+					return
+				}
+				lc.Append(fx.Hook{
+					OnStart: func(ctx context.Context) error {
+						return a.Start()
+					},
+					OnStop: func(ctx context.Context) error {
+						return a.Stop()
+					},
+				})
+			},
+			func(lc fx.Lifecycle, m metrics.Server) {
+				if m == nil {
+					return
+				}
+				lc.Append(fx.Hook{
+					OnStart: func(ctx context.Context) error {
+						return m.Start()
+					},
+					OnStop: func(ctx context.Context) error {
+						return m.Stop()
+					},
+				})
+			},
 		),
 	)
 }
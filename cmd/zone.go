@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/shawnburke/dnsmock/spec"
+)
+
+const zoneUsage = `usage:
+  dnsmock zone import [-origin name] ZONE_FILE [SPEC_FILE]
+  dnsmock zone export [-origin name] SPEC_FILE [ZONE_FILE]
+
+import converts a zone file to a replay spec, and export a replay
+spec to a zone file.  Output goes to stdout if no file is given.
+`
+
+// runZone runs the zone subcommand, converting between zone files and specs
+func runZone(args []string, stdout io.Writer, stderr io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, zoneUsage)
+		return errors.New("missing zone command")
+	}
+
+	command := args[0]
+	fs := flag.NewFlagSet("dnsmock zone "+command, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, zoneUsage) }
+	origin := fs.String("origin", "", "Origin for relative names")
+
+	var convert func(in string, out io.Writer) error
+	switch command {
+	case "import":
+		convert = func(in string, out io.Writer) error {
+			s, err := spec.FromZoneFile(in, *origin)
+			if err != nil {
+				return err
+			}
+			y, err := s.YAML()
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(out, y)
+			return err
+		}
+	case "export":
+		convert = func(in string, out io.Writer) error {
+			s, err := spec.FromFile(in)
+			if err != nil {
+				return err
+			}
+			return s.WriteZone(out, *origin)
+		}
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown zone command %q", command)
+	}
+
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return fmt.Errorf("zone %s needs an input file and optionally an output file", command)
+	}
+
+	if fs.NArg() == 1 {
+		return convert(fs.Arg(0), stdout)
+	}
+
+	// convert in full before touching the output, which may be the input
+	var out bytes.Buffer
+	if err := convert(fs.Arg(0), &out); err != nil {
+		return err
+	}
+	return writeFile(fs.Arg(1), out.Bytes())
+}
+
+// writeFile replaces path with content by way of a temporary file,
+// so that a failed write leaves whatever was there alone
+func writeFile(path string, content []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/shawnburke/dnsmock/spec"
+	"github.com/stretchr/testify/require"
+)
+
+func TestZone(t *testing.T) {
+	dir := t.TempDir()
+	zoneFile := path.Join(dir, "example.zone")
+	specFile := path.Join(dir, "example.yaml")
+	err := os.WriteFile(zoneFile, []byte("$TTL 300\n@ IN A 10.0.0.1\nwww IN A 10.0.0.2\n"), 0644)
+	require.NoError(t, err)
+
+	require.NoError(t, runZone([]string{"import", "-origin", "example.com.", zoneFile, specFile}, io.Discard, io.Discard))
+	s, err := spec.FromFile(specFile)
+	require.NoError(t, err)
+	require.Len(t, s.Rules, 2)
+	require.Equal(t, "www.example.com.", s.Rules[1].Name)
+
+	var out bytes.Buffer
+	require.NoError(t, runZone([]string{"export", "-origin", "example.com.", specFile}, &out, io.Discard))
+	require.Equal(t, "$ORIGIN example.com.\n$TTL 300\n@\tIN\tA\t10.0.0.1\nwww\tIN\tA\t10.0.0.2\n", out.String())
+
+	var stderr strings.Builder
+	require.Error(t, runZone(nil, io.Discard, &stderr))
+	require.Contains(t, stderr.String(), "usage:")
+	require.Error(t, runZone([]string{"convert", zoneFile, path.Join(dir, "out")}, io.Discard, io.Discard))
+	require.NoFileExists(t, path.Join(dir, "out"))
+	require.Error(t, runZone([]string{"import"}, io.Discard, io.Discard))
+	require.Error(t, runZone([]string{"import", path.Join(dir, "missing.zone")}, io.Discard, io.Discard))
+
+	// a failed conversion leaves the output as it was
+	require.Error(t, runZone([]string{"export", zoneFile, specFile}, io.Discard, io.Discard))
+	_, err = spec.FromFile(specFile)
+	require.NoError(t, err)
+}
+
+func TestZoneInPlace(t *testing.T) {
+	file := path.Join(t.TempDir(), "example.yaml")
+	err := os.WriteFile(file, []byte(`
+rules:
+  - name: example.com.
+    records:
+      A: ["example.com. 300 IN A 10.0.0.1"]
+`), 0644)
+	require.NoError(t, err)
+
+	require.NoError(t, runZone([]string{"export", file, file}, io.Discard, io.Discard))
+	content, err := os.ReadFile(file)
+	require.NoError(t, err)
+	require.Equal(t, "$ORIGIN .\n$TTL 300\nexample.com.\tIN\tA\t10.0.0.1\n", string(content))
+
+	entries, err := os.ReadDir(path.Dir(file))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
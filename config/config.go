@@ -1,17 +1,33 @@
 package config
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
 	"strings"
+
+	"gopkg.in/yaml.v3"
 )
 
 type Parameters struct {
-	Port           int    `yaml:"port"`
-	DownstreamsRaw string `yaml:"downstreams"`
-	Record         bool   `yaml:"record"`
-	ReplayFile     string `yaml:"replay_file"`
-	RecordFile     string `yaml:"record_file"`
-	Verbose        bool   `yaml:"verbose"`
+	Port               int             `yaml:"port"`
+	DownstreamsRaw     string          `yaml:"downstreams"`
+	Record             bool            `yaml:"record"`
+	ReplayFile         string          `yaml:"replay_file"`
+	RecordFile         string          `yaml:"record_file"`
+	Verbose            bool            `yaml:"verbose"`
+	Unmatched          UnmatchedPolicy `yaml:"unmatched"`
+	CacheSize          int             `yaml:"cache_size"`
+	AdminAddr          string          `yaml:"admin_addr"`
+	MetricsAddr        string          `yaml:"metrics_addr"`
+	QueryLog           string          `yaml:"query_log"`
+	QueryLogMaxSizeMB  int             `yaml:"query_log_max_size_mb"`
+	QueryLogMaxBackups int             `yaml:"query_log_max_backups"`
+	Strict             bool            `yaml:"strict"`
+	StrictExitCode     int             `yaml:"strict_exit_code"`
 }
 
 func (p Parameters) ListenAddr() string {
@@ -30,3 +46,200 @@ func (p Parameters) IsDownstreamLocalhost() bool {
 	ds := p.Downstreams()
 	return len(ds) == 1 && ds[0] == "localhost"
 }
+
+// MetricsOnAdmin is whether metrics are served by the admin
+// server, as they share an address
+func (p Parameters) MetricsOnAdmin() bool {
+	return p.MetricsAddr != "" && p.MetricsAddr == p.AdminAddr
+}
+
+// UnmatchedPolicy decides what a query that no resolver
+// could answer gets back.
+type UnmatchedPolicy string
+
+const (
+	// UnmatchedNoData answers NOERROR with no records and an SOA, the default
+	UnmatchedNoData UnmatchedPolicy = "nodata"
+	// UnmatchedNXDomain answers NXDOMAIN with an SOA
+	UnmatchedNXDomain UnmatchedPolicy = "nxdomain"
+	// UnmatchedServFail answers SERVFAIL
+	UnmatchedServFail UnmatchedPolicy = "servfail"
+	// UnmatchedRefused answers REFUSED
+	UnmatchedRefused UnmatchedPolicy = "refused"
+)
+
+var unmatchedPolicies = []UnmatchedPolicy{
+	UnmatchedNoData,
+	UnmatchedNXDomain,
+	UnmatchedServFail,
+	UnmatchedRefused,
+}
+
+// Validate returns an error if the policy is not one of the known values.
+// The empty policy is valid and means UnmatchedNoData.
+func (u UnmatchedPolicy) Validate() error {
+	if u == "" {
+		return nil
+	}
+	names := []string{}
+	for _, p := range unmatchedPolicies {
+		if p == u {
+			return nil
+		}
+		names = append(names, string(p))
+	}
+	return fmt.Errorf("unknown unmatched policy %q, expected one of %s", string(u), strings.Join(names, ", "))
+}
+
+// String implements flag.Value
+func (u *UnmatchedPolicy) String() string {
+	if u == nil {
+		return ""
+	}
+	return string(*u)
+}
+
+// Set implements flag.Value
+func (u *UnmatchedPolicy) Set(val string) error {
+	p := UnmatchedPolicy(strings.ToLower(strings.TrimSpace(val)))
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	*u = p
+	return nil
+}
+
+// UnmarshalYAML reads the policy as Set does, from a config file
+func (u *UnmatchedPolicy) UnmarshalYAML(node *yaml.Node) error {
+	var val string
+	if err := node.Decode(&val); err != nil {
+		return err
+	}
+	if err := u.Set(val); err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	return nil
+}
+
+// EnvPrefix prefixes the environment variables that set parameters,
+// e.g. DNSMOCK_PORT for `port`.
+const EnvPrefix = "DNSMOCK_"
+
+// LoadFile reads parameters from a YAML or JSON file on top of the
+// current ones; keys missing from the file are left as they are.
+func (p *Parameters) LoadFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config: %w", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(p); err != nil && err != io.EOF {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// LoadEnv sets parameters from DNSMOCK_* variables in environ,
+// given as "key=value" like os.Environ returns.  The variable for
+// a parameter is its YAML key in upper case with the prefix.
+func (p *Parameters) LoadEnv(environ []string) error {
+	env := map[string]string{}
+	for _, kv := range environ {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			env[k] = v
+		}
+	}
+
+	val := reflect.ValueOf(p).Elem()
+	for i := 0; i < val.NumField(); i++ {
+		key := strings.Split(val.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+
+		name := EnvPrefix + strings.ToUpper(key)
+		raw, ok := env[name]
+		if !ok {
+			continue
+		}
+
+		field := val.Field(i)
+
+		// types parsed like flags, such as UnmatchedPolicy
+		if v, ok := field.Addr().Interface().(interface{ Set(string) error }); ok {
+			if err := v.Set(raw); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			continue
+		}
+
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(raw)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(raw)
+			if err != nil {
+				return fmt.Errorf("%s: %q is not a boolean", name, raw)
+			}
+			field.SetBool(b)
+		case reflect.Int:
+			n, err := strconv.Atoi(raw)
+			if err != nil {
+				return fmt.Errorf("%s: %q is not an integer", name, raw)
+			}
+			field.SetInt(int64(n))
+		default:
+			return fmt.Errorf("%s: unsupported parameter type %s", name, field.Kind())
+		}
+	}
+	return nil
+}
+
+// Validate checks the parameters, returning an error
+// describing every problem found.
+func (p Parameters) Validate() error {
+	problems := []string{}
+
+	if p.Port < 0 || p.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("port: %d is out of range", p.Port))
+	}
+
+	if p.CacheSize < 0 {
+		problems = append(problems, fmt.Sprintf("cache_size: %d must not be negative", p.CacheSize))
+	}
+
+	if p.QueryLogMaxSizeMB < 0 {
+		problems = append(problems, fmt.Sprintf("query_log_max_size_mb: %d must not be negative", p.QueryLogMaxSizeMB))
+	}
+
+	if p.QueryLogMaxBackups < 0 {
+		problems = append(problems, fmt.Sprintf("query_log_max_backups: %d must not be negative", p.QueryLogMaxBackups))
+	}
+
+	if p.StrictExitCode < 0 || p.StrictExitCode > 125 {
+		problems = append(problems, fmt.Sprintf("strict_exit_code: %d is out of range", p.StrictExitCode))
+	}
+
+	if p.Strict && p.Record {
+		problems = append(problems, "strict: can't record in strict mode, as nothing goes downstream")
+	}
+
+	if err := p.Unmatched.Validate(); err != nil {
+		problems = append(problems, fmt.Sprintf("unmatched: %v", err))
+	}
+
+	for _, d := range p.Downstreams() {
+		if suffix, server, ok := strings.Cut(d, "="); ok {
+			if strings.TrimSpace(suffix) == "" || strings.TrimSpace(server) == "" {
+				problems = append(problems, fmt.Sprintf("downstreams: %q should be suffix=server", d))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, name string, content string) string {
+	p := path.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(p, []byte(content), 0644))
+	return p
+}
+
+func TestLoadFile(t *testing.T) {
+	p := Parameters{Port: 53, Verbose: true}
+
+	err := p.LoadFile(writeConfig(t, "dnsmock.yaml", `
+port: 9053
+downstreams: 8.8.8.8,1.1.1.1
+replay_file: replay.yaml
+unmatched: " NXDOMAIN"
+cache_size: 100
+`))
+	require.NoError(t, err)
+	require.Equal(t, Parameters{
+		Port:           9053,
+		DownstreamsRaw: "8.8.8.8,1.1.1.1",
+		ReplayFile:     "replay.yaml",
+		Verbose:        true,
+		Unmatched:      UnmatchedNXDomain,
+		CacheSize:      100,
+	}, p)
+
+	p = Parameters{}
+	err = p.LoadFile(writeConfig(t, "dnsmock.json", `{"port": 5353, "record": true}`))
+	require.NoError(t, err)
+	require.Equal(t, Parameters{Port: 5353, Record: true}, p)
+
+	err = p.LoadFile(writeConfig(t, "empty.yaml", ""))
+	require.NoError(t, err)
+}
+
+func TestLoadFileErrors(t *testing.T) {
+	p := Parameters{}
+
+	err := p.LoadFile(writeConfig(t, "typo.yaml", "prot: 53\n"))
+	require.ErrorContains(t, err, "field prot not found")
+	require.ErrorContains(t, err, "typo.yaml")
+
+	err = p.LoadFile(writeConfig(t, "type.yaml", "port: lots\n"))
+	require.ErrorContains(t, err, "line 1")
+
+	err = p.LoadFile(writeConfig(t, "policy.yaml", "port: 53\nunmatched: sometimes\n"))
+	require.ErrorContains(t, err, "line 2")
+	require.ErrorContains(t, err, "unknown unmatched policy")
+
+	err = p.LoadFile(path.Join(t.TempDir(), "missing.yaml"))
+	require.Error(t, err)
+}
+
+func TestLoadEnv(t *testing.T) {
+	p := Parameters{Port: 53, DownstreamsRaw: "localhost"}
+
+	err := p.LoadEnv([]string{
+		"HOME=/root",
+		"DNSMOCK_PORT=9053",
+		"DNSMOCK_RECORD=true",
+		"DNSMOCK_DOWNSTREAMS=8.8.8.8",
+		"DNSMOCK_UNMATCHED=Refused",
+	})
+	require.NoError(t, err)
+	require.Equal(t, Parameters{
+		Port:           9053,
+		Record:         true,
+		DownstreamsRaw: "8.8.8.8",
+		Unmatched:      UnmatchedRefused,
+	}, p)
+
+	require.ErrorContains(t, p.LoadEnv([]string{"DNSMOCK_PORT=x"}), "DNSMOCK_PORT")
+	require.ErrorContains(t, p.LoadEnv([]string{"DNSMOCK_VERBOSE=maybe"}), "DNSMOCK_VERBOSE")
+	require.ErrorContains(t, p.LoadEnv([]string{"DNSMOCK_UNMATCHED=sometimes"}), "DNSMOCK_UNMATCHED")
+}
+
+func TestValidate(t *testing.T) {
+	require.NoError(t, Parameters{Port: 53, DownstreamsRaw: "corp.=10.0.0.1,8.8.8.8"}.Validate())
+
+	err := Parameters{
+		Port:           70000,
+		CacheSize:      -1,
+		Unmatched:      "nope",
+		DownstreamsRaw: "=10.0.0.1",
+	}.Validate()
+	require.ErrorContains(t, err, "port")
+	require.ErrorContains(t, err, "cache_size")
+	require.ErrorContains(t, err, "unmatched")
+	require.ErrorContains(t, err, "downstreams")
+
+	err = Parameters{Strict: true, Record: true, StrictExitCode: 300}.Validate()
+	require.ErrorContains(t, err, "strict:")
+	require.ErrorContains(t, err, "strict_exit_code")
+}
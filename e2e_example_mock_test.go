@@ -27,7 +27,13 @@ func TestMock(t *testing.T) {
 	logger := zap.NewNop()
 
 	// spec is our wrapper around the YAML config
-	s := spec.FromYAML(specYaml)
+	s, err := spec.FromYAML(specYaml)
+	require.NoError(t, err)
+
+	// expect google.com. to be looked up once, and nothing
+	// in prod, which Verify checks at the end
+	s.Expect("google.com.", dns.TypeA).Times(1)
+	s.Expect("*.prod.", dns.TypeNone).Never()
 
 	// a replay resolver resolves DNS using the spec
 	resolver := resolver.NewReplay(s, logger)
@@ -36,7 +42,7 @@ func TestMock(t *testing.T) {
 	// only
 	proxy := New(":0", resolver, logger)
 
-	err := proxy.Start()
+	err = proxy.Start()
 	require.NoError(t, err)
 	defer proxy.Stop()
 
@@ -63,4 +69,5 @@ func TestMock(t *testing.T) {
 	a := res.Answer[0].(*dns.A)
 	require.Equal(t, "4.3.2.1", a.A.String())
 
+	s.Verify(t)
 }
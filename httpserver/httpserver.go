@@ -0,0 +1,83 @@
+// Package httpserver runs the HTTP servers dnsmock has beside DNS,
+// such as the admin API and metrics.
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Server is an HTTP server that can be started and stopped
+type Server interface {
+	Start() error
+	Stop() error
+	// Addr is the address the server is listening on
+	Addr() string
+}
+
+type server struct {
+	sync.Mutex
+	logger  *zap.Logger
+	addr    string
+	handler http.Handler
+	http    *http.Server
+}
+
+// New creates a server for handler, named in its logs
+func New(name string, addr string, handler http.Handler, logger *zap.Logger) Server {
+	return &server{
+		logger:  logger.With(zap.String("server", name)),
+		addr:    addr,
+		handler: handler,
+	}
+}
+
+// Start listens, returning once the server is ready for requests
+func (s *server) Start() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.http != nil {
+		return errors.New("AlreadyStarted")
+	}
+
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		s.logger.Error("Failed to start HTTP server", zap.Error(err))
+		return err
+	}
+
+	s.addr = listener.Addr().String()
+	s.http = &http.Server{Handler: s.handler}
+	go func(h *http.Server) {
+		if err := h.Serve(listener); err != nil && err != http.ErrServerClosed {
+			s.logger.Error("HTTP server failed", zap.Error(err))
+		}
+	}(s.http)
+
+	s.logger.Info("HTTP server started", zap.String("addr", s.addr))
+	return nil
+}
+
+func (s *server) Stop() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.http == nil {
+		return nil
+	}
+	err := s.http.Shutdown(context.Background())
+	s.http = nil
+	return err
+}
+
+func (s *server) Addr() string {
+	s.Lock()
+	defer s.Unlock()
+	return s.addr
+}
@@ -0,0 +1,37 @@
+package httpserver
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestServer(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "hello")
+	})
+	s := New("test", "127.0.0.1:0", handler, zap.NewNop())
+	require.NoError(t, s.Start())
+	require.Error(t, s.Start())
+
+	res, err := http.Get("http://" + s.Addr() + "/")
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(body))
+
+	require.NoError(t, s.Stop())
+	require.NoError(t, s.Stop())
+	_, err = http.Get("http://" + s.Addr() + "/")
+	require.Error(t, err)
+
+	// it can start again after stopping
+	require.NoError(t, s.Start())
+	require.NoError(t, s.Stop())
+
+	require.Error(t, New("test", "127.0.0.1:-1", handler, zap.NewNop()).Start())
+}
@@ -0,0 +1,78 @@
+// Package metrics holds the Prometheus metrics dnsmock records, and
+// serves them along with the Go runtime and process metrics.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// Metrics are the metrics the proxy and resolvers record
+type Metrics struct {
+	// Queries counts queries handled by query type and rcode
+	Queries *prometheus.CounterVec
+	// QueryDuration times queries handled by protocol
+	QueryDuration *prometheus.HistogramVec
+	// ReplayLookups counts replay lookups by result
+	ReplayLookups *prometheus.CounterVec
+	// UpstreamDuration times queries to upstream servers by server
+	UpstreamDuration *prometheus.HistogramVec
+	// UpstreamErrors counts failed upstream queries by server
+	UpstreamErrors *prometheus.CounterVec
+	// RecorderEntries counts responses recorded
+	RecorderEntries prometheus.Counter
+}
+
+// NewRegistry creates a registry with the Go runtime and
+// process metrics in it
+func NewRegistry() *prometheus.Registry {
+	r := prometheus.NewRegistry()
+	r.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return r
+}
+
+// New creates the metrics and registers them with registerer,
+// unless it is nil, e.g. for resolvers whose metrics aren't served
+func New(registerer prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		Queries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dnsmock_queries_total",
+			Help: "Queries handled by query type and response code, which is DROPPED for dropped queries.",
+		}, []string{"qtype", "rcode"}),
+		QueryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "dnsmock_query_duration_seconds",
+			Help: "Time taken to handle queries, in seconds.",
+		}, []string{"protocol"}),
+		ReplayLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dnsmock_replay_lookups_total",
+			Help: "Replay lookups by result: hit, miss or error.",
+		}, []string{"result"}),
+		UpstreamDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "dnsmock_upstream_duration_seconds",
+			Help: "Time taken by upstream DNS servers to answer, in seconds.",
+		}, []string{"server"}),
+		UpstreamErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dnsmock_upstream_errors_total",
+			Help: "Queries to upstream DNS servers that failed or were answered SERVFAIL or REFUSED.",
+		}, []string{"server"}),
+		RecorderEntries: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dnsmock_recorder_entries_total",
+			Help: "Responses recorded.",
+		}),
+	}
+
+	if registerer != nil {
+		registerer.MustRegister(
+			m.Queries,
+			m.QueryDuration,
+			m.ReplayLookups,
+			m.UpstreamDuration,
+			m.UpstreamErrors,
+			m.RecorderEntries,
+		)
+	}
+	return m
+}
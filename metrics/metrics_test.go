@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/shawnburke/dnsmock/config"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestNew(t *testing.T) {
+	r := NewRegistry()
+	m := New(r)
+
+	m.Queries.WithLabelValues("A", "NOERROR").Inc()
+	m.Queries.WithLabelValues("A", "NOERROR").Inc()
+	m.UpstreamDuration.WithLabelValues("8.8.8.8:53").Observe(0.05)
+	m.RecorderEntries.Inc()
+
+	require.Equal(t, float64(2), testutil.ToFloat64(m.Queries.WithLabelValues("A", "NOERROR")))
+	require.Equal(t, 1, testutil.CollectAndCount(m.UpstreamDuration))
+
+	families, err := r.Gather()
+	require.NoError(t, err)
+	names := map[string]bool{}
+	for _, f := range families {
+		names[f.GetName()] = true
+	}
+	require.True(t, names["dnsmock_queries_total"])
+	require.True(t, names["dnsmock_upstream_duration_seconds"])
+	require.True(t, names["dnsmock_recorder_entries_total"])
+	require.True(t, names["go_goroutines"])
+
+	// metrics for another registry, or none, don't clash
+	New(prometheus.NewRegistry())
+	New(nil).Queries.WithLabelValues("A", "NOERROR").Inc()
+	require.Equal(t, float64(2), testutil.ToFloat64(m.Queries.WithLabelValues("A", "NOERROR")))
+}
+
+func TestServer(t *testing.T) {
+	r := NewRegistry()
+	New(r).RecorderEntries.Inc()
+
+	s := NewServer("127.0.0.1:0", r, zap.NewNop())
+	require.NoError(t, s.Start())
+	defer s.Stop()
+
+	res, err := http.Get("http://" + s.Addr() + "/metrics")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Contains(t, res.Header.Get("Content-Type"), "text/plain")
+	require.Contains(t, string(body), "dnsmock_recorder_entries_total 1\n")
+	require.Contains(t, string(body), "go_goroutines ")
+}
+
+func TestServerFromConfig(t *testing.T) {
+	r := NewRegistry()
+	require.Nil(t, NewServerFromConfig(config.Parameters{}, r, zap.NewNop()))
+	require.NotNil(t, NewServerFromConfig(config.Parameters{MetricsAddr: ":9153"}, r, zap.NewNop()))
+	// the admin server serves them instead
+	require.Nil(t, NewServerFromConfig(config.Parameters{MetricsAddr: ":8053", AdminAddr: ":8053"}, r, zap.NewNop()))
+}
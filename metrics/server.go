@@ -0,0 +1,37 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/shawnburke/dnsmock/config"
+	"github.com/shawnburke/dnsmock/httpserver"
+	"go.uber.org/zap"
+)
+
+// Server serves a registry at /metrics
+type Server interface {
+	httpserver.Server
+}
+
+// Handler serves the metrics in gatherer, as for /metrics
+func Handler(gatherer prometheus.Gatherer) http.Handler {
+	return promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})
+}
+
+// NewServer creates a server for the metrics in gatherer
+func NewServer(addr string, gatherer prometheus.Gatherer, logger *zap.Logger) Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler(gatherer))
+	return httpserver.New("metrics", addr, mux, logger)
+}
+
+// NewServerFromConfig creates a server for registry if an address is
+// configured, nil otherwise, or if the admin server serves the metrics
+func NewServerFromConfig(cfg config.Parameters, registry *prometheus.Registry, logger *zap.Logger) Server {
+	if cfg.MetricsAddr == "" || cfg.MetricsOnAdmin() {
+		return nil
+	}
+	return NewServer(cfg.MetricsAddr, registry, logger)
+}
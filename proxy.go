@@ -1,119 +1,375 @@
 package dnsmock
 
 import (
+	"context"
 	"errors"
+	"net"
 	"sync"
 	"time"
 
 	"github.com/miekg/dns"
 	"github.com/shawnburke/dnsmock/config"
+	"github.com/shawnburke/dnsmock/metrics"
+	"github.com/shawnburke/dnsmock/querylog"
 	"github.com/shawnburke/dnsmock/resolver"
+	"github.com/shawnburke/dnsmock/spec"
 	"go.uber.org/zap"
 )
 
+// bindAttempts is how many times Start tries to find a port
+// free for both UDP and TCP when asked for any port.
+const bindAttempts = 5
+
 type Proxy interface {
 	Start() error
 	Stop() error
+	// Addr is the address the proxy is serving on, shared by
+	// its UDP and TCP listeners.
 	Addr() string
 }
 
 type proxy struct {
 	sync.Mutex
-	logger   *zap.Logger
-	addr     string
-	server   *dns.Server
-	resolver resolver.Resolver
+	logger    *zap.Logger
+	addr      string
+	servers   []*dns.Server
+	resolver  resolver.Resolver
+	unmatched config.UnmatchedPolicy
+	queryLog  *querylog.Log
+	metrics   *metrics.Metrics
+
+	// ctx is cancelled on Stop to abandon in flight resolutions
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Option configures optional proxy behavior
+type Option func(p *proxy)
+
+// WithUnmatched sets what queries no resolver answered get back,
+// by default NODATA.
+func WithUnmatched(policy config.UnmatchedPolicy) Option {
+	return func(p *proxy) {
+		p.unmatched = policy
+	}
+}
+
+// WithQueryLog logs every query handled to l, if not nil
+func WithQueryLog(l *querylog.Log) Option {
+	return func(p *proxy) {
+		p.queryLog = l
+	}
+}
+
+// WithMetrics records the queries handled in m, rather than
+// in metrics that aren't registered anywhere
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(p *proxy) {
+		p.metrics = m
+	}
 }
 
 func New(
 	addr string,
 	resolver resolver.Resolver,
-	logger *zap.Logger) Proxy {
+	logger *zap.Logger,
+	opts ...Option) Proxy {
 
 	if addr == "" {
 		addr = "0.0.0.0:0"
 	}
 
-	return &proxy{
+	p := &proxy{
 		logger:   logger,
 		addr:     addr,
 		resolver: resolver,
+		metrics:  metrics.New(nil),
 	}
 
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
 }
 
-func NewFromConfig(cfg config.Parameters, resolver resolver.Resolver, logger *zap.Logger) Proxy {
-	return New(cfg.ListenAddr(), resolver, logger)
+func NewFromConfig(cfg config.Parameters, resolver resolver.Resolver, logger *zap.Logger, opts ...Option) Proxy {
+	return New(cfg.ListenAddr(), resolver, logger,
+		append([]Option{WithUnmatched(cfg.Unmatched)}, opts...)...,
+	)
 
 }
 
+// Start binds the UDP and TCP listeners and returns once both are serving.
 func (p *proxy) Start() error {
 	p.Lock()
 	defer p.Unlock()
-	var err error
 
-	if p.server != nil {
+	if p.servers != nil {
 		return errors.New("AlreadyStarted")
 	}
 
-	p.server = &dns.Server{Addr: p.addr, Net: "udp"}
-	p.server.Handler = dns.HandlerFunc(p.handler)
+	if err := p.unmatched.Validate(); err != nil {
+		return err
+	}
 
-	go func() {
-		err = p.server.ListenAndServe()
+	_, port, err := net.SplitHostPort(p.addr)
+	if err != nil {
+		return err
+	}
+
+	// set up before any handler can run
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+
+	for attempt := 1; ; attempt++ {
+		// UDP goes first so that if we were asked for any port,
+		// TCP can follow on the one that was picked
+		udp, err := p.listen("udp", p.addr)
 		if err != nil {
-			p.logger.Error("Failed to start DNS server", zap.Error(err))
+			p.cancel()
+			return err
 		}
-	}()
-	time.Sleep(time.Millisecond * 100)
-	if err == nil {
-		p.addr = p.server.PacketConn.LocalAddr().String()
+		addr := udp.PacketConn.LocalAddr().String()
+
+		tcp, err := p.listen("tcp", addr)
+		if err != nil {
+			udp.Shutdown()
+
+			// the picked port may be taken for TCP, so pick again
+			if port == "0" && attempt < bindAttempts {
+				continue
+			}
+			p.cancel()
+			return err
+		}
+
+		p.addr = addr
+		p.servers = []*dns.Server{udp, tcp}
 		p.logger.Info("DNS server started", zap.String("addr", p.addr))
+		return nil
+	}
+}
+
+// listen binds a server synchronously and waits for it to start serving
+func (p *proxy) listen(network string, addr string) (*dns.Server, error) {
+	server := &dns.Server{Net: network}
+	server.Handler = dns.HandlerFunc(p.handler)
+
+	if network == "udp" {
+		conn, err := net.ListenPacket(network, addr)
+		if err != nil {
+			p.logger.Error("Failed to start DNS server", zap.String("net", network), zap.Error(err))
+			return nil, err
+		}
+		server.PacketConn = conn
+	} else {
+		listener, err := net.Listen(network, addr)
+		if err != nil {
+			p.logger.Error("Failed to start DNS server", zap.String("net", network), zap.Error(err))
+			return nil, err
+		}
+		server.Listener = listener
+	}
+
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() {
+		close(started)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ActivateAndServe()
+	}()
+
+	select {
+	case <-started:
+		return server, nil
+	case err := <-errs:
+		p.logger.Error("Failed to start DNS server", zap.String("net", network), zap.Error(err))
+		if server.PacketConn != nil {
+			server.PacketConn.Close()
+		}
+		if server.Listener != nil {
+			server.Listener.Close()
+		}
+		return nil, err
 	}
-	return err
 }
 
 func (p *proxy) Addr() string {
+	p.Lock()
+	defer p.Unlock()
 	return p.addr
 }
 
 func (p *proxy) handler(w dns.ResponseWriter, question *dns.Msg) {
+	start := time.Now()
 
-	response, err := p.resolver.Resolve(question)
+	req := &resolver.Request{
+		Msg:        question,
+		RemoteAddr: w.RemoteAddr(),
+		Protocol:   protocol(w),
+	}
 
-	msg := &dns.Msg{}
-	defer func() {
+	response, err := p.resolver.ResolveContext(p.ctx, req)
+
+	switch {
+	case errors.Is(err, resolver.ErrDrop):
+		p.logger.Debug("Dropping DNS request", zap.String("question", question.Question[0].String()))
+		p.observe(start, req, nil, err)
+		return
+	case errors.As(err, new(*resolver.RcodeError)):
+		// an answer the resolver chose, such as strict mode's REFUSED
+		p.logger.Debug("Answering DNS request with rcode", zap.Error(err))
+		response = new(dns.Msg)
+		response.SetRcode(question, resolver.Rcode(err))
+	case err != nil:
+		p.logger.Error("Failed to handle DNS request", zap.Error(err))
+		response = new(dns.Msg)
+		response.SetRcode(question, resolver.Rcode(err))
+	case response == nil:
+		response = p.unmatchedResponse(question)
+	default:
+		response.SetRcode(question, response.Rcode)
+		p.logger.Debug("Got response",
+			zap.String("question", question.Question[0].String()),
+			zap.Any("answer", resolver.AnswerStrings(response)),
+		)
+	}
+
+	edns(question, response)
+	truncate(w, question, response)
+	w.WriteMsg(response)
+	p.observe(start, req, response, err)
+}
+
+// observe counts the handling of a query, and writes it to the
+// query log if there is one
+func (p *proxy) observe(start time.Time, req *resolver.Request, response *dns.Msg, err error) {
+	rcode := "DROPPED"
+	if response != nil {
+		rcode = dns.RcodeToString[response.Rcode]
+	}
+	p.metrics.Queries.WithLabelValues(dns.TypeToString[req.Question().Qtype], rcode).Inc()
+	p.metrics.QueryDuration.WithLabelValues(req.Protocol).Observe(time.Since(start).Seconds())
+
+	if p.queryLog == nil {
+		return
+	}
+
+	entry := querylog.NewEntry(start, req.Msg, response)
+	if req.RemoteAddr != nil {
+		entry.Client = req.RemoteAddr.String()
+	}
+	entry.Protocol = req.Protocol
+	entry.Source = req.Source()
+	if err != nil && !errors.Is(err, resolver.ErrDrop) {
+		entry.Error = err.Error()
+	}
+
+	if err := p.queryLog.Write(entry); err != nil {
+		p.logger.Warn("Failed to write query log", zap.Error(err))
+	}
+}
+
+// unmatchedResponse builds the reply for a query no resolver answered,
+// according to the unmatched policy.
+func (p *proxy) unmatchedResponse(question *dns.Msg) *dns.Msg {
+	response := new(dns.Msg)
+
+	switch p.unmatched {
+	case config.UnmatchedServFail:
+		return response.SetRcode(question, dns.RcodeServerFailure)
+	case config.UnmatchedRefused:
+		return response.SetRcode(question, dns.RcodeRefused)
+	case config.UnmatchedNXDomain:
+		response.SetRcode(question, dns.RcodeNameError)
+	default:
 		response.SetReply(question)
-		w.WriteMsg(response)
-	}()
+	}
 
-	if response == nil {
-		response = &dns.Msg{}
+	// negative answers carry an SOA so clients know how long to cache them
+	if len(question.Question) > 0 {
+		response.Ns = []dns.RR{spec.NegativeSOA(question.Question[0].Name)}
 	}
+	return response
+}
 
-	if err != nil {
-		p.logger.Error("Failed to handle DNS request", zap.Error(err))
-		msg.SetRcode(question, dns.RcodeServerFailure)
+// protocol is the transport a query arrived on
+func protocol(w dns.ResponseWriter) string {
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// edns answers a query that has an OPT record with one, if the response
+// has none, e.g. when it was made from a spec.  It echoes the size the
+// client asked for, and its DO bit.
+func edns(question *dns.Msg, response *dns.Msg) {
+	opt := question.IsEdns0()
+	if opt == nil || response.IsEdns0() != nil {
 		return
 	}
+	size := opt.UDPSize()
+	if size < dns.MinMsgSize {
+		size = dns.MinMsgSize
+	}
+	response.SetEdns0(size, opt.Do())
+}
 
-	p.logger.Debug("Got response",
-		zap.String("question", question.Question[0].String()),
-		zap.Any("answer", resolver.AnswerStrings(response)),
-	)
+// truncate fits a response into the payload size the client can take
+// over UDP, which sets the TC bit if records have to be dropped.  Responses
+// already marked truncated, e.g. by a spec rule, are emptied so the client
+// retries over TCP, where the full response is sent.
+func truncate(w dns.ResponseWriter, question *dns.Msg, response *dns.Msg) {
+	if protocol(w) != "udp" {
+		response.Truncated = false
+		return
+	}
+
+	if response.Truncated {
+		opt := response.IsEdns0()
+		response.Answer = nil
+		response.Ns = nil
+		response.Extra = nil
+		if opt != nil {
+			response.Extra = []dns.RR{opt}
+		}
+		return
+	}
 
+	size := dns.MinMsgSize
+	if opt := question.IsEdns0(); opt != nil {
+		size = int(opt.UDPSize())
+	}
+	response.Truncate(size)
 }
 
 func (p *proxy) Stop() error {
+	p.Lock()
+	defer p.Unlock()
+
 	p.logger.Info("Stopping DNS server")
-	return p.server.Shutdown()
+
+	if p.cancel != nil {
+		p.cancel()
+	}
+
+	var err error
+	for _, server := range p.servers {
+		if e := server.Shutdown(); e != nil && err == nil {
+			err = e
+		}
+	}
+	p.servers = nil
+	return err
 }
 
-func (p *proxy) send(msg *dns.Msg) (*dns.Msg, error) {
+func (p *proxy) send(msg *dns.Msg, network string) (*dns.Msg, error) {
 	client := &dns.Client{
-		Net: "udp",
+		Net: network,
 	}
-	res, _, err := client.Exchange(msg, p.server.PacketConn.LocalAddr().String())
+	res, _, err := client.Exchange(msg, p.Addr())
 
 	return res, err
 
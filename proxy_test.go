@@ -1,13 +1,28 @@
 package dnsmock
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"os"
+	"path"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/shawnburke/dnsmock/config"
+	"github.com/shawnburke/dnsmock/metrics"
+	"github.com/shawnburke/dnsmock/querylog"
 	"github.com/shawnburke/dnsmock/resolver"
+	"github.com/shawnburke/dnsmock/spec"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 var logger = zap.NewNop()
@@ -37,7 +52,7 @@ func TestProxySimple(t *testing.T) {
 	}
 
 	proxy := p.(*proxy)
-	res, err := proxy.send(msg)
+	res, err := proxy.send(msg, "udp")
 
 	require.NoError(t, err)
 	require.NotNil(t, res)
@@ -48,6 +63,379 @@ func TestProxySimple(t *testing.T) {
 
 }
 
+func mustSpec(t *testing.T, y string) *spec.Responses {
+	s, err := spec.FromYAML(y)
+	require.NoError(t, err)
+	return s
+}
+
+func TestProxyTCP(t *testing.T) {
+	s := mustSpec(t, specYaml)
+	p := New("127.0.0.1:0", resolver.NewReplay(s, logger), logger)
+
+	err := p.Start()
+	require.NoError(t, err)
+	defer p.Stop()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("google.com.", dns.TypeA)
+
+	proxy := p.(*proxy)
+	for _, network := range []string{"udp", "tcp"} {
+		res, err := proxy.send(msg, network)
+		require.NoError(t, err, network)
+		require.Len(t, res.Answer, 1, network)
+		require.Equal(t, "4.3.2.1", res.Answer[0].(*dns.A).A.String(), network)
+	}
+}
+
+func truncateSpec() string {
+	b := &strings.Builder{}
+	b.WriteString("rules:\n - name: big.test.\n   records:\n    A:\n")
+	for i := 0; i < 64; i++ {
+		fmt.Fprintf(b, "    - \"big.test. 300 IN A 10.0.0.%d\"\n", i)
+	}
+	b.WriteString(" - name: forced.test.\n   truncated: true\n   records:\n    A:\n    - \"forced.test. 300 IN A 10.0.0.1\"\n")
+	return b.String()
+}
+
+func TestProxyStartReady(t *testing.T) {
+	s := mustSpec(t, specYaml)
+
+	for i := 0; i < 4; i++ {
+		t.Run("parallel", func(t *testing.T) {
+			t.Parallel()
+			p := New("127.0.0.1:0", resolver.NewReplay(s, logger), logger)
+			require.NoError(t, p.Start())
+			defer p.Stop()
+
+			// no waiting, Start only returns once we are serving
+			msg := new(dns.Msg)
+			msg.SetQuestion("google.com.", dns.TypeA)
+			res, err := p.(*proxy).send(msg, "udp")
+			require.NoError(t, err)
+			require.Len(t, res.Answer, 1)
+		})
+	}
+}
+
+func TestProxyStartInUse(t *testing.T) {
+	s := mustSpec(t, specYaml)
+	p := New("127.0.0.1:0", resolver.NewReplay(s, logger), logger)
+	require.NoError(t, p.Start())
+	defer p.Stop()
+
+	p2 := New(p.Addr(), resolver.NewReplay(s, logger), logger)
+	require.Error(t, p2.Start())
+}
+
+func TestProxyTruncate(t *testing.T) {
+	s := mustSpec(t, truncateSpec())
+	p := New("127.0.0.1:0", resolver.NewReplay(s, logger), logger)
+
+	err := p.Start()
+	require.NoError(t, err)
+	defer p.Stop()
+	proxy := p.(*proxy)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("big.test.", dns.TypeA)
+
+	res, err := proxy.send(msg, "udp")
+	require.NoError(t, err)
+	require.True(t, res.Truncated)
+	require.Less(t, len(res.Answer), 64)
+	res.Compress = true
+	require.LessOrEqual(t, res.Len(), dns.MinMsgSize)
+
+	res, err = proxy.send(msg, "tcp")
+	require.NoError(t, err)
+	require.False(t, res.Truncated)
+	require.Len(t, res.Answer, 64)
+
+	msg.SetEdns0(4096, true)
+	res, err = proxy.send(msg, "udp")
+	require.NoError(t, err)
+	require.False(t, res.Truncated)
+	require.Len(t, res.Answer, 64)
+	// the reply has an OPT record too, echoing the query's
+	opt := res.IsEdns0()
+	require.NotNil(t, opt)
+	require.Equal(t, uint16(4096), opt.UDPSize())
+	require.True(t, opt.Do())
+
+	// a small EDNS size still truncates, keeping the OPT record
+	msg.SetQuestion("big.test.", dns.TypeA)
+	msg.Extra = nil
+	msg.SetEdns0(800, false)
+	res, err = proxy.send(msg, "udp")
+	require.NoError(t, err)
+	require.True(t, res.Truncated)
+	require.Less(t, len(res.Answer), 64)
+	require.NotNil(t, res.IsEdns0())
+	res.Compress = true
+	require.LessOrEqual(t, res.Len(), 800)
+
+	msg = new(dns.Msg)
+	msg.SetQuestion("forced.test.", dns.TypeA)
+
+	res, err = proxy.send(msg, "udp")
+	require.NoError(t, err)
+	require.True(t, res.Truncated)
+	require.Empty(t, res.Answer)
+	require.Nil(t, res.IsEdns0())
+
+	msg.SetEdns0(1232, false)
+	res, err = proxy.send(msg, "udp")
+	require.NoError(t, err)
+	require.True(t, res.Truncated)
+	require.Empty(t, res.Answer)
+	require.NotNil(t, res.IsEdns0())
+	msg.Extra = nil
+
+	res, err = proxy.send(msg, "tcp")
+	require.NoError(t, err)
+	require.False(t, res.Truncated)
+	require.Len(t, res.Answer, 1)
+}
+
+type errorResolver struct {
+	err error
+}
+
+func (r errorResolver) Resolve(msg *dns.Msg) (*dns.Msg, error) {
+	return nil, r.err
+}
+
+func TestProxyRcodes(t *testing.T) {
+	s := mustSpec(t, specYaml)
+
+	cases := []struct {
+		name     string
+		resolver resolver.Resolver
+		policy   config.UnmatchedPolicy
+		rcode    int
+		soa      bool
+	}{
+		{
+			name:     "default",
+			resolver: resolver.NewReplay(s, logger),
+			rcode:    dns.RcodeSuccess,
+			soa:      true,
+		},
+		{
+			name:     "nxdomain",
+			resolver: resolver.NewReplay(s, logger),
+			policy:   config.UnmatchedNXDomain,
+			rcode:    dns.RcodeNameError,
+			soa:      true,
+		},
+		{
+			name:     "servfail",
+			resolver: resolver.NewReplay(s, logger),
+			policy:   config.UnmatchedServFail,
+			rcode:    dns.RcodeServerFailure,
+		},
+		{
+			name:     "refused",
+			resolver: resolver.NewReplay(s, logger),
+			policy:   config.UnmatchedRefused,
+			rcode:    dns.RcodeRefused,
+		},
+		{
+			name:     "error",
+			resolver: resolver.FromLegacy(errorResolver{err: errors.New("boom")}),
+			rcode:    dns.RcodeServerFailure,
+		},
+		{
+			name:     "rcode error",
+			resolver: resolver.FromLegacy(errorResolver{err: &resolver.RcodeError{Rcode: dns.RcodeRefused}}),
+			rcode:    dns.RcodeRefused,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := New("127.0.0.1:0", c.resolver, logger, WithUnmatched(c.policy))
+			err := p.Start()
+			require.NoError(t, err)
+			defer p.Stop()
+
+			msg := new(dns.Msg)
+			msg.SetQuestion("unmatched.test.", dns.TypeA)
+
+			res, err := p.(*proxy).send(msg, "udp")
+			require.NoError(t, err)
+			require.Equal(t, c.rcode, res.Rcode)
+			require.Empty(t, res.Answer)
+			if c.soa {
+				require.Len(t, res.Ns, 1)
+				require.IsType(t, &dns.SOA{}, res.Ns[0])
+			} else {
+				require.Empty(t, res.Ns)
+			}
+		})
+	}
+}
+
+func TestProxyFaults(t *testing.T) {
+	s := mustSpec(t, `
+rules:
+  - name: "slow.example."
+    delay: 300ms
+    records:
+      A: ["slow.example. 60 IN A 10.0.0.1"]
+  - name: "fast.example."
+    records:
+      A: ["fast.example. 60 IN A 10.0.0.2"]
+  - name: "lost.example."
+    drop: 1
+    records:
+      A: ["lost.example. 60 IN A 10.0.0.3"]
+`)
+	p := New("127.0.0.1:0", resolver.NewReplay(s, logger), logger)
+	require.NoError(t, p.Start())
+	defer p.Stop()
+
+	query := func(name string) (*dns.Msg, time.Duration, error) {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		client := &dns.Client{Timeout: time.Second}
+		return client.Exchange(msg, p.Addr())
+	}
+
+	// a slow query doesn't hold up others
+	slow := make(chan error)
+	go func() {
+		_, rtt, err := query("slow.example.")
+		if err == nil && rtt < 300*time.Millisecond {
+			err = fmt.Errorf("slow query took %v", rtt)
+		}
+		slow <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	res, rtt, err := query("fast.example.")
+	require.NoError(t, err)
+	require.Len(t, res.Answer, 1)
+	require.Less(t, rtt, 200*time.Millisecond)
+	require.NoError(t, <-slow)
+
+	_, _, err = query("lost.example.")
+	require.Error(t, err)
+	var netErr net.Error
+	require.True(t, errors.As(err, &netErr) && netErr.Timeout(), err.Error())
+}
+
+func TestProxyQueryLog(t *testing.T) {
+	s := mustSpec(t, `
+rules:
+  - name: "api.test."
+    records:
+      A: ["api.test. 60 IN A 10.0.0.1"]
+  - name: "lost.test."
+    drop: 1
+    records:
+      A: ["lost.test. 60 IN A 10.0.0.2"]
+`)
+	file := path.Join(t.TempDir(), "queries.jsonl")
+	l, err := querylog.New(file, 0, 0)
+	require.NoError(t, err)
+
+	p := New("127.0.0.1:0", resolver.NewReplay(s, logger), logger, WithQueryLog(l))
+	require.NoError(t, p.Start())
+	defer p.Stop()
+
+	client := &dns.Client{Net: "tcp", Timeout: 200 * time.Millisecond}
+	for _, name := range []string{"api.test.", "other.test.", "lost.test."} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		client.Exchange(msg, p.Addr())
+	}
+	require.NoError(t, p.Stop())
+	require.NoError(t, l.Close())
+
+	raw, err := os.ReadFile(file)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	require.Len(t, lines, 3)
+
+	entries := map[string]querylog.Entry{}
+	for _, line := range lines {
+		e := querylog.Entry{}
+		require.NoError(t, json.Unmarshal([]byte(line), &e))
+		entries[e.Name] = e
+	}
+
+	e := entries["api.test."]
+	require.Equal(t, "tcp", e.Protocol)
+	require.Contains(t, e.Client, "127.0.0.1:")
+	require.Equal(t, "NOERROR", e.Rcode)
+	require.Equal(t, "replay", e.Source)
+	require.Len(t, e.Answers, 1)
+
+	e = entries["other.test."]
+	require.Equal(t, "NOERROR", e.Rcode)
+	require.Empty(t, e.Source)
+	require.Empty(t, e.Answers)
+
+	require.True(t, entries["lost.test."].Dropped)
+}
+
+func TestProxyMetrics(t *testing.T) {
+	s := mustSpec(t, `
+rules:
+  - name: "api.test."
+    records:
+      A: ["api.test. 60 IN A 10.0.0.1"]
+  - name: "lost.test."
+    drop: 1
+    records:
+      A: ["lost.test. 60 IN A 10.0.0.2"]
+`)
+	m := metrics.New(nil)
+	p := New("127.0.0.1:0", resolver.NewReplay(s, logger), logger, WithMetrics(m))
+	require.NoError(t, p.Start())
+	defer p.Stop()
+
+	client := &dns.Client{Net: "tcp", Timeout: 200 * time.Millisecond}
+	for _, name := range []string{"api.test.", "api.test.", "lost.test."} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		client.Exchange(msg, p.Addr())
+	}
+	require.NoError(t, p.Stop())
+
+	require.Equal(t, float64(2), testutil.ToFloat64(m.Queries.WithLabelValues("A", "NOERROR")))
+	require.Equal(t, float64(1), testutil.ToFloat64(m.Queries.WithLabelValues("A", "DROPPED")))
+	handled := &dto.Metric{}
+	require.NoError(t, m.QueryDuration.WithLabelValues("tcp").(prometheus.Histogram).Write(handled))
+	require.Equal(t, uint64(3), handled.GetHistogram().GetSampleCount())
+}
+
+func TestProxyStrictLogs(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	strict := resolver.NewStrict(resolver.NewReplay(spec.New(), logger), zap.New(core))
+	p := New("127.0.0.1:0", strict, zap.New(core))
+	require.NoError(t, p.Start())
+	defer p.Stop()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("unexpected.test.", dns.TypeA)
+	res, err := p.(*proxy).send(msg, "udp")
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, res.Rcode)
+
+	// strict mode warns, and refusing is no failure of the proxy
+	require.Equal(t, 1, logs.FilterLevelExact(zap.WarnLevel).Len())
+	require.Zero(t, logs.FilterLevelExact(zap.ErrorLevel).Len())
+}
+
+func TestProxyBadPolicy(t *testing.T) {
+	p := New("127.0.0.1:0", resolver.FromLegacy(errorResolver{}), logger, WithUnmatched("bogus"))
+	require.Error(t, p.Start())
+}
+
 func TestParse(t *testing.T) {
 	val := "internet.com.		300	IN	A	172.64.154.149"
 
@@ -0,0 +1,191 @@
+// Package querylog writes a JSON line for each query the proxy handles,
+// to a file or stdout, rotating the file when it gets too big.
+package querylog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/shawnburke/dnsmock/config"
+)
+
+// Stdout is the path that sends the log to stdout
+const Stdout = "-"
+
+// Entry is one handled query
+type Entry struct {
+	Time time.Time `json:"time"`
+	// Client is the address the query came from
+	Client string `json:"client,omitempty"`
+	// Protocol is "udp" or "tcp"
+	Protocol string `json:"protocol,omitempty"`
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Class    string `json:"class"`
+	// Rcode is empty if the query was dropped
+	Rcode   string   `json:"rcode,omitempty"`
+	Answers []string `json:"answers,omitempty"`
+	// Source is the resolver that answered, e.g. "replay" or
+	// "dns:8.8.8.8:53", empty if none did
+	Source string `json:"source,omitempty"`
+	// Error is why resolving failed, if it did
+	Error   string  `json:"error,omitempty"`
+	Dropped bool    `json:"dropped,omitempty"`
+	Latency float64 `json:"latency_ms"`
+}
+
+// NewEntry describes a query and its response, which is nil if
+// the query was dropped
+func NewEntry(start time.Time, query *dns.Msg, response *dns.Msg) Entry {
+	e := Entry{
+		Time:    start,
+		Latency: float64(time.Since(start)) / float64(time.Millisecond),
+		Dropped: response == nil,
+	}
+	if len(query.Question) > 0 {
+		q := query.Question[0]
+		e.Name = q.Name
+		e.Type = dns.TypeToString[q.Qtype]
+		e.Class = dns.ClassToString[q.Qclass]
+	}
+	if response != nil {
+		e.Rcode = dns.RcodeToString[response.Rcode]
+		for _, rr := range response.Answer {
+			e.Answers = append(e.Answers, rr.String())
+		}
+	}
+	return e
+}
+
+// Log writes entries as JSON lines
+type Log struct {
+	sync.Mutex
+	path string
+	// maxSize is how big the file gets before it is rotated, 0 for no limit
+	maxSize int64
+	// maxBackups is how many rotated files to keep
+	maxBackups int
+	out        io.Writer
+	file       *os.File
+	size       int64
+}
+
+// New opens a log at path, appending to it, or logs to stdout if the
+// path is Stdout.  Once the file reaches maxSize bytes it is renamed to
+// path.1, with older ones moving up to path.2 and so on, keeping
+// maxBackups of them.  A maxSize of zero never rotates.
+func New(path string, maxSize int64, maxBackups int) (*Log, error) {
+	l := &Log{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if path == Stdout {
+		l.out = os.Stdout
+		return l, nil
+	}
+
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// NewFromConfig opens the configured log, nil if there is none
+func NewFromConfig(cfg config.Parameters) (*Log, error) {
+	if cfg.QueryLog == "" {
+		return nil, nil
+	}
+	return New(cfg.QueryLog, int64(cfg.QueryLogMaxSizeMB)<<20, cfg.QueryLogMaxBackups)
+}
+
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.out, l.size = f, f, stat.Size()
+	return nil
+}
+
+// Write logs an entry
+func (l *Log) Write(e Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.Lock()
+	defer l.Unlock()
+
+	if l.out == nil {
+		return fmt.Errorf("query log %s is closed", l.path)
+	}
+
+	// a failed rotation is tried again on the next write, and
+	// meanwhile the entry goes to the file as it is
+	var rotateErr error
+	if l.file != nil && l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		rotateErr = l.rotate()
+	}
+	if l.out == nil {
+		return rotateErr
+	}
+
+	n, err := l.out.Write(line)
+	l.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return err
+}
+
+// rotate moves the current file to path.1, and the older ones up,
+// dropping the oldest, then starts a new file.  If the file can't
+// be moved it is opened again, to carry on with.
+func (l *Log) rotate() error {
+	err := l.file.Close()
+	l.file, l.out = nil, nil
+
+	if err == nil {
+		err = l.shift()
+	}
+	if openErr := l.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+// shift renames the file and its backups up one,
+// or removes the file if there are no backups
+func (l *Log) shift() error {
+	if l.maxBackups == 0 {
+		return os.Remove(l.path)
+	}
+	os.Remove(fmt.Sprintf("%s.%d", l.path, l.maxBackups))
+	for i := l.maxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	return os.Rename(l.path, l.path+".1")
+}
+
+// Close closes the file, if logging to one
+func (l *Log) Close() error {
+	l.Lock()
+	defer l.Unlock()
+
+	l.out = nil
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
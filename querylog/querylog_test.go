@@ -0,0 +1,117 @@
+package querylog
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func readEntries(t *testing.T, file string) []Entry {
+	f, err := os.Open(file)
+	require.NoError(t, err)
+	defer f.Close()
+
+	entries := []Entry{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		e := Entry{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		entries = append(entries, e)
+	}
+	require.NoError(t, scanner.Err())
+	return entries
+}
+
+func TestNewEntry(t *testing.T) {
+	query := new(dns.Msg)
+	query.SetQuestion("api.test.", dns.TypeA)
+	response := new(dns.Msg)
+	response.SetRcode(query, dns.RcodeNameError)
+	rr, err := dns.NewRR("api.test. 60 IN A 10.0.0.1")
+	require.NoError(t, err)
+	response.Answer = []dns.RR{rr}
+
+	start := time.Now().Add(-5 * time.Millisecond)
+	e := NewEntry(start, query, response)
+	require.Equal(t, "api.test.", e.Name)
+	require.Equal(t, "A", e.Type)
+	require.Equal(t, "IN", e.Class)
+	require.Equal(t, "NXDOMAIN", e.Rcode)
+	require.Equal(t, []string{rr.String()}, e.Answers)
+	require.False(t, e.Dropped)
+	require.GreaterOrEqual(t, e.Latency, 5.0)
+
+	e = NewEntry(start, query, nil)
+	require.True(t, e.Dropped)
+	require.Empty(t, e.Rcode)
+}
+
+func TestLogRotation(t *testing.T) {
+	file := path.Join(t.TempDir(), "queries.jsonl")
+
+	l, err := New(file, 300, 2)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, l.Write(Entry{Name: "api.test.", Type: "A", Class: "IN", Rcode: "NOERROR"}))
+	}
+	require.NoError(t, l.Close())
+	require.Error(t, l.Write(Entry{}))
+
+	// every file is within the limit, and only two old ones are kept
+	total := 0
+	for _, name := range []string{file, file + ".1", file + ".2"} {
+		stat, err := os.Stat(name)
+		require.NoError(t, err)
+		require.LessOrEqual(t, stat.Size(), int64(300))
+		total += len(readEntries(t, name))
+	}
+	require.Less(t, total, 10)
+	_, err = os.Stat(file + ".3")
+	require.True(t, os.IsNotExist(err))
+
+	// reopening appends
+	before := len(readEntries(t, file))
+	l, err = New(file, 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, l.Write(Entry{Name: "db.test."}))
+	require.NoError(t, l.Close())
+	entries := readEntries(t, file)
+	require.Len(t, entries, before+1)
+	require.Equal(t, "db.test.", entries[before].Name)
+}
+
+func TestLogRotationFails(t *testing.T) {
+	file := path.Join(t.TempDir(), "queries.jsonl")
+
+	// a directory in the way of the backup can't be replaced
+	require.NoError(t, os.MkdirAll(path.Join(file+".1", "taken"), 0755))
+
+	l, err := New(file, 200, 1)
+	require.NoError(t, err)
+
+	failed := 0
+	for i := 0; i < 5; i++ {
+		if l.Write(Entry{Name: "api.test.", Type: "A", Class: "IN", Rcode: "NOERROR"}) != nil {
+			failed++
+		}
+	}
+	require.NotZero(t, failed)
+
+	// nothing was lost, and once the way is clear rotation works again
+	require.Len(t, readEntries(t, file), 5)
+	require.NoError(t, os.RemoveAll(file+".1"))
+	require.NoError(t, l.Write(Entry{Name: "db.test."}))
+	require.NoError(t, l.Close())
+
+	require.Len(t, readEntries(t, file+".1"), 5)
+	entries := readEntries(t, file)
+	require.Len(t, entries, 1)
+	require.Equal(t, "db.test.", entries[0].Name)
+}
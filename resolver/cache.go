@@ -0,0 +1,174 @@
+package resolver
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// NewCache creates a resolver that caches answers from another resolver,
+// for as long as their record TTLs allow.  Negative answers are cached
+// per the SOA in their authority section.  At most maxEntries answers are
+// kept, the least recently used are evicted first.
+func NewCache(next Resolver, maxEntries int, logger *zap.Logger) Resolver {
+	return &cacheResolver{
+		next:       next,
+		maxEntries: maxEntries,
+		entries:    map[cacheKey]*list.Element{},
+		lru:        list.New(),
+		now:        time.Now,
+		logger:     logger.With(zap.String("resolver", "cache")),
+	}
+}
+
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+type cacheResolver struct {
+	sync.Mutex
+	next       Resolver
+	maxEntries int
+	entries    map[cacheKey]*list.Element
+	lru        *list.List
+	now        func() time.Time
+	logger     *zap.Logger
+}
+
+func (r *cacheResolver) ResolveContext(ctx context.Context, req *Request) (*dns.Msg, error) {
+	question := req.Question()
+	key := cacheKey{
+		name:   dns.CanonicalName(question.Name),
+		qtype:  question.Qtype,
+		qclass: question.Qclass,
+	}
+
+	if response := r.get(key); response != nil {
+		r.logger.Debug("CACHE-RESOLVER: hit", zap.String("question", question.String()))
+		req.SetSource("cache")
+		return response, nil
+	}
+
+	response, err := r.next.ResolveContext(ctx, req)
+	if err != nil || response == nil {
+		return response, err
+	}
+
+	if ttl := cacheTTL(response); ttl > 0 {
+		r.put(key, response, ttl)
+	}
+	return response, nil
+}
+
+func (r *cacheResolver) get(key cacheKey) *dns.Msg {
+	r.Lock()
+	defer r.Unlock()
+
+	elem, ok := r.entries[key]
+	if !ok {
+		return nil
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	now := r.now()
+	if !now.Before(entry.expires) {
+		r.lru.Remove(elem)
+		delete(r.entries, key)
+		return nil
+	}
+	r.lru.MoveToFront(elem)
+
+	// count the TTLs down by the time spent in the cache
+	response := entry.msg.Copy()
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	for _, section := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if rr.Header().Ttl > elapsed {
+				rr.Header().Ttl -= elapsed
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+	return response
+}
+
+func (r *cacheResolver) put(key cacheKey, response *dns.Msg, ttl uint32) {
+	r.Lock()
+	defer r.Unlock()
+
+	now := r.now()
+	entry := &cacheEntry{
+		key:     key,
+		msg:     response.Copy(),
+		stored:  now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	if elem, ok := r.entries[key]; ok {
+		elem.Value = entry
+		r.lru.MoveToFront(elem)
+		return
+	}
+
+	r.entries[key] = r.lru.PushFront(entry)
+
+	for r.maxEntries > 0 && r.lru.Len() > r.maxEntries {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// cacheTTL is how long a response may be cached for, which is the lowest
+// TTL among its answers or, for a negative response, the SOA's negative TTL.
+// Zero means don't cache it.
+func cacheTTL(response *dns.Msg) uint32 {
+	if response.Truncated {
+		return 0
+	}
+
+	if len(response.Answer) > 0 {
+		if response.Rcode != dns.RcodeSuccess {
+			return 0
+		}
+		ttl := response.Answer[0].Header().Ttl
+		for _, rr := range response.Answer[1:] {
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+		return ttl
+	}
+
+	if response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError {
+		return 0
+	}
+
+	// RFC 2308: negative answers live for the lesser of the SOA's TTL and MINIMUM
+	for _, rr := range response.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			if soa.Minttl < soa.Hdr.Ttl {
+				return soa.Minttl
+			}
+			return soa.Hdr.Ttl
+		}
+	}
+	return 0
+}
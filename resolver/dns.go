@@ -1,10 +1,13 @@
 package resolver
 
 import (
+	"context"
+	"fmt"
 	"strings"
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/shawnburke/dnsmock/metrics"
 	"go.uber.org/zap"
 )
 
@@ -12,8 +15,13 @@ const timeout = 5 * time.Second
 
 // new DNS resolver
 func NewDns(server string, logger *zap.Logger) Resolver {
+	return newDns(server, metrics.New(nil), logger)
+}
+
+func newDns(server string, m *metrics.Metrics, logger *zap.Logger) Resolver {
 	r := &dnsResolver{
-		server: NormalizeServers(server)[0],
+		server:  NormalizeServers(server)[0],
+		metrics: m,
 		client: &dns.Client{
 			Net:          "udp",
 			ReadTimeout:  timeout,
@@ -25,15 +33,20 @@ func NewDns(server string, logger *zap.Logger) Resolver {
 }
 
 type dnsResolver struct {
-	server string
-	client *dns.Client
-	logger *zap.Logger
+	server  string
+	client  *dns.Client
+	metrics *metrics.Metrics
+	logger  *zap.Logger
 }
 
-func (r *dnsResolver) Resolve(m *dns.Msg) (*dns.Msg, error) {
+func (r *dnsResolver) ResolveContext(ctx context.Context, req *Request) (*dns.Msg, error) {
+	m := req.Msg
 
-	response, _, err := r.client.Exchange(m, r.server)
+	start := time.Now()
+	response, _, err := r.client.ExchangeContext(ctx, m, r.server)
+	r.metrics.UpstreamDuration.WithLabelValues(r.server).Observe(time.Since(start).Seconds())
 	if err != nil {
+		r.metrics.UpstreamErrors.WithLabelValues(r.server).Inc()
 		r.logger.Error(
 			"DNS-RESOLVER: Failed to forward DNS request",
 			zap.Error(err),
@@ -46,6 +59,13 @@ func (r *dnsResolver) Resolve(m *dns.Msg) (*dns.Msg, error) {
 		zap.String("question", m.Question[0].String()),
 		zap.String("response", response.String()),
 	)
+
+	// the server failing us is an error, so the next one gets tried
+	if response.Rcode == dns.RcodeServerFailure || response.Rcode == dns.RcodeRefused {
+		r.metrics.UpstreamErrors.WithLabelValues(r.server).Inc()
+		return nil, &RcodeError{Rcode: response.Rcode, Err: fmt.Errorf("%s answered %s", r.server, dns.RcodeToString[response.Rcode])}
+	}
+	req.SetSource("dns:" + r.server)
 	return response, nil
 }
 
@@ -0,0 +1,42 @@
+package resolver
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/miekg/dns"
+	"github.com/shawnburke/dnsmock/spec"
+)
+
+// RcodeError is a resolution failure that should be answered
+// with a specific rcode.
+type RcodeError struct {
+	Rcode int
+	Err   error
+}
+
+func (e *RcodeError) Error() string {
+	rcode := dns.RcodeToString[e.Rcode]
+	if e.Err == nil {
+		return rcode
+	}
+	return fmt.Sprintf("%s: %v", rcode, e.Err)
+}
+
+func (e *RcodeError) Unwrap() error {
+	return e.Err
+}
+
+// ErrDrop means the query should get no response at all,
+// as when a replay rule drops it.
+var ErrDrop = spec.ErrDrop
+
+// Rcode maps a resolution error to the rcode sent back to the
+// client, which is SERVFAIL unless the error carries its own.
+func Rcode(err error) int {
+	var rcodeErr *RcodeError
+	if errors.As(err, &rcodeErr) {
+		return rcodeErr.Rcode
+	}
+	return dns.RcodeServerFailure
+}
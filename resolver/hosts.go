@@ -0,0 +1,154 @@
+package resolver
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// DownstreamHostsPrefix selects a hosts file as a downstream, e.g. "hosts:/etc/hosts"
+const DownstreamHostsPrefix = "hosts:"
+
+// HostsTTL is the TTL of answers from a hosts file
+const HostsTTL = 60
+
+// NewHosts creates a resolver that answers A, AAAA and PTR queries from
+// a file in /etc/hosts format, reloading it when it changes.
+func NewHosts(path string, logger *zap.Logger) Resolver {
+	return &hostsResolver{path: path, logger: logger.With(zap.String("resolver", "hosts"))}
+}
+
+type hostsResolver struct {
+	sync.Mutex
+	path        string
+	logger      *zap.Logger
+	hosts       *hosts
+	lastModTime time.Time
+}
+
+// hosts is a loaded hosts file
+type hosts struct {
+	// addrs holds the addresses of each name, by canonical name
+	addrs map[string][]net.IP
+	// names holds the first name of each address, by reverse name
+	names map[string]string
+}
+
+func (r *hostsResolver) ResolveContext(ctx context.Context, req *Request) (*dns.Msg, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	h, err := r.loadHosts()
+	if err != nil {
+		return nil, err
+	}
+
+	question := req.Question()
+	name := dns.CanonicalName(question.Name)
+	hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: HostsTTL}
+
+	answers := []dns.RR{}
+	switch question.Qtype {
+	case dns.TypeA:
+		for _, ip := range h.addrs[name] {
+			if ip4 := ip.To4(); ip4 != nil {
+				answers = append(answers, &dns.A{Hdr: hdr, A: ip4})
+			}
+		}
+	case dns.TypeAAAA:
+		for _, ip := range h.addrs[name] {
+			if ip.To4() == nil {
+				answers = append(answers, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+	case dns.TypePTR:
+		if host, ok := h.names[name]; ok {
+			answers = append(answers, &dns.PTR{Hdr: hdr, Ptr: host})
+		}
+	}
+
+	if len(answers) == 0 {
+		r.logger.Debug("HOSTS: no match", zap.String("question", question.String()))
+		return nil, nil
+	}
+
+	response := &dns.Msg{}
+	response.SetReply(req.Msg)
+	response.Answer = answers
+	req.SetSource("hosts")
+	return response, nil
+}
+
+// loadHosts returns the hosts, reading the file again if it changed
+func (r *hostsResolver) loadHosts() (*hosts, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	stat, err := os.Stat(r.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.hosts != nil && stat.ModTime().Equal(r.lastModTime) {
+		return r.hosts, nil
+	}
+
+	r.logger.Debug("HOSTS: Loading hosts file", zap.String("path", r.path))
+	h, err := readHosts(r.path)
+	if err != nil {
+		return nil, err
+	}
+
+	r.hosts = h
+	r.lastModTime = stat.ModTime()
+	return r.hosts, nil
+}
+
+// readHosts parses a hosts file: an address then its names on each
+// line, with anything after a # ignored
+func readHosts(path string) (*hosts, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := &hosts{addrs: map[string][]net.IP{}, names: map[string]string{}}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		// zones, as in fe80::1%lo0, don't go in DNS answers
+		addr, _, _ := strings.Cut(fields[0], "%")
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+
+		for _, name := range fields[1:] {
+			name = dns.CanonicalName(name)
+			h.addrs[name] = append(h.addrs[name], ip)
+		}
+
+		reverse, err := dns.ReverseAddr(ip.String())
+		if err != nil {
+			continue
+		}
+		if _, ok := h.names[reverse]; !ok {
+			h.names[reverse] = dns.Fqdn(fields[1])
+		}
+	}
+	return h, scanner.Err()
+}
@@ -1,6 +1,7 @@
 package resolver
 
 import (
+	"context"
 	"os"
 	"sync"
 	"time"
@@ -26,7 +27,8 @@ type localResolver struct {
 	lastModTime time.Time
 }
 
-func (r *localResolver) Resolve(msg *dns.Msg) (*dns.Msg, error) {
+func (r *localResolver) ResolveContext(ctx context.Context, req *Request) (*dns.Msg, error) {
+	msg := req.Msg
 
 	local, err := r.loadLocalConfig()
 
@@ -35,6 +37,8 @@ func (r *localResolver) Resolve(msg *dns.Msg) (*dns.Msg, error) {
 	}
 
 	response := &dns.Msg{}
+	// negative is the last negative answer, given if no name has answers
+	var negative *dns.Msg
 
 	name := msg.Question[0].Name
 	names := local.NameList(name)
@@ -42,23 +46,44 @@ func (r *localResolver) Resolve(msg *dns.Msg) (*dns.Msg, error) {
 	r.logger.Debug("LOCAL: Resolving", zap.String("name", name), zap.Strings("names", names))
 Outer:
 	for _, n := range names {
+		// query a copy, the request belongs to the caller
+		search := msg.Copy()
+		search.Question[0].Name = n
+		sreq := &Request{Msg: search, RemoteAddr: req.RemoteAddr, Protocol: req.Protocol}
+
 		for _, s := range servers {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
 			resolver := NewDns(s, r.logger)
-			msg.Question[0].Name = n
-			rx, err := resolver.Resolve(msg)
+			rx, err := resolver.ResolveContext(ctx, sreq)
 			if err != nil {
 				continue
 			}
 
 			if rx != nil && len(rx.Answer) > 0 {
 				response = rx
+				req.SetSource("local")
 				break Outer
 			}
+
+			// the name doesn't exist, or has no records of the type,
+			// so other servers needn't be asked
+			if answered(rx) {
+				negative = rx
+				break
+			}
 		}
-		msg.Question[0].Name = name
 	}
 
+	if len(response.Answer) == 0 && negative != nil {
+		response = negative
+		req.SetSource("local")
+	}
+
+	rcode := response.Rcode
 	response.SetReply(msg)
+	response.Rcode = rcode
 	return response, nil
 }
 
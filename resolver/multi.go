@@ -1,24 +1,54 @@
 package resolver
 
-import "github.com/miekg/dns"
+import (
+	"context"
+	"errors"
+
+	"github.com/miekg/dns"
+)
 
 func NewMulti(resolvers ...Resolver) Resolver {
 	return &multiResolver{resolvers: resolvers}
 }
 
+// answered reports whether a response settles a query, so no other
+// resolver need be asked.  That is if it has answers, or is a negative
+// answer, meaning an SOA or an rcode saying so.
+func answered(response *dns.Msg) bool {
+	if response == nil {
+		return false
+	}
+	return len(response.Answer) > 0 || len(response.Ns) > 0 || response.Rcode != dns.RcodeSuccess
+}
+
 type multiResolver struct {
 	resolvers []Resolver
 }
 
-func (r *multiResolver) Resolve(msg *dns.Msg) (*dns.Msg, error) {
+// ResolveContext returns the first answer from the resolvers, in order.  If
+// none of them answered and any failed, the last error is returned so that
+// the client gets a failure rather than an empty answer.  A dropped query
+// is not passed on.
+func (r *multiResolver) ResolveContext(ctx context.Context, req *Request) (*dns.Msg, error) {
+	var lastErr error
 	for _, resolver := range r.resolvers {
-		response, err := resolver.Resolve(msg)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		// only the resolver that answers gets to say so
+		req.SetSource("")
+		response, err := resolver.ResolveContext(ctx, req)
+		if errors.Is(err, ErrDrop) {
+			return nil, err
+		}
 		if err != nil {
+			lastErr = err
 			continue
 		}
-		if response != nil && len(response.Answer) > 0 {
+		if answered(response) {
 			return response, nil
 		}
 	}
-	return nil, nil
+	req.SetSource("")
+	return nil, lastErr
 }
@@ -1,16 +1,24 @@
 package resolver
 
 import (
+	"context"
+
 	"github.com/miekg/dns"
+	"github.com/shawnburke/dnsmock/metrics"
 	"github.com/shawnburke/dnsmock/spec"
 	"go.uber.org/zap"
 )
 
 // NewRecorder creates a resolver that records responses from another resolver
 func NewRecorder(r Resolver, responses *spec.Responses, logger *zap.Logger) Resolver {
+	return newRecorder(r, responses, metrics.New(nil), logger)
+}
+
+func newRecorder(r Resolver, responses *spec.Responses, m *metrics.Metrics, logger *zap.Logger) Resolver {
 	return &recorderResolver{
 		resolver:  r,
 		responses: responses,
+		metrics:   m,
 		logger:    logger.With(zap.String("resolver", "recorder")),
 	}
 }
@@ -18,20 +26,34 @@ func NewRecorder(r Resolver, responses *spec.Responses, logger *zap.Logger) Reso
 type recorderResolver struct {
 	resolver  Resolver
 	responses *spec.Responses
+	metrics   *metrics.Metrics
 	logger    *zap.Logger
 }
 
-func (r *recorderResolver) Resolve(msg *dns.Msg) (*dns.Msg, error) {
-	response, err := r.resolver.Resolve(msg)
+func (r *recorderResolver) ResolveContext(ctx context.Context, req *Request) (*dns.Msg, error) {
+	msg := req.Msg
+	question := req.Question()
+	response, err := r.resolver.ResolveContext(ctx, req)
 	if err != nil {
 		return nil, err
 	}
-	if response != nil && len(response.Answer) > 0 {
+	// negative answers are recorded too, with their SOA
+	if answered(response) {
 		r.logger.Debug("RECORDER-RESOLVER: recording response",
-			zap.String("question", msg.Question[0].String()),
+			zap.String("question", question.String()),
 			zap.Strings("answer", AnswerStrings(response)),
 		)
 		r.responses.Add(msg, response)
+		r.metrics.RecorderEntries.Inc()
+
+		// answer the way the recording will be replayed, unless
+		// it was replayed, and so arranged already
+		if req.Source() == "replay" {
+			return response, nil
+		}
+		if err := r.responses.Arrange(msg, response); err != nil {
+			r.logger.Warn("RECORDER-RESOLVER: error arranging answers", zap.Error(err))
+		}
 	}
 	return response, nil
 }
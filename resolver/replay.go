@@ -1,38 +1,79 @@
 package resolver
 
 import (
+	"context"
+	"errors"
+
 	"github.com/miekg/dns"
+	"github.com/shawnburke/dnsmock/metrics"
 	"github.com/shawnburke/dnsmock/spec"
 	"go.uber.org/zap"
 )
 
 // NewReplay creates a resolver that replays canned messages
 func NewReplay(r *spec.Responses, logger *zap.Logger) Resolver {
-	return &replayResolver{responses: r, logger: logger.With(zap.String("resolver", "replay"))}
+	return newReplay(r, metrics.New(nil), logger)
 }
 
-func NewReplayFromFile(p string, logger *zap.Logger) Resolver {
-	s := spec.FromFile(p)
+func newReplay(r *spec.Responses, m *metrics.Metrics, logger *zap.Logger) Resolver {
+	return &replayResolver{responses: r, metrics: m, logger: logger.With(zap.String("resolver", "replay"))}
+}
 
-	return NewReplay(s, logger)
+// NewReplayFromFile creates a replay resolver from a spec file,
+// failing if the spec can't be loaded.
+func NewReplayFromFile(p string, logger *zap.Logger) (Resolver, error) {
+	s, err := spec.FromFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewReplay(s, logger), nil
 }
 
 type replayResolver struct {
 	responses *spec.Responses
+	metrics   *metrics.Metrics
 	logger    *zap.Logger
 }
 
-func (r *replayResolver) Resolve(msg *dns.Msg) (*dns.Msg, error) {
-	response := r.responses.Find(msg)
+func (r *replayResolver) ResolveContext(ctx context.Context, req *Request) (*dns.Msg, error) {
+	msg := req.Msg
+	question := req.Question()
+	response, err := r.responses.LookupContext(ctx, spec.Query{
+		Msg:          msg,
+		ClientIP:     req.ClientIP(),
+		ClientSubnet: req.ClientSubnet(),
+	})
+	switch {
+	case err != nil && !errors.Is(err, ErrDrop):
+		r.metrics.ReplayLookups.WithLabelValues("error").Inc()
+	case response == nil && err == nil:
+		r.metrics.ReplayLookups.WithLabelValues("miss").Inc()
+	default:
+		r.metrics.ReplayLookups.WithLabelValues("hit").Inc()
+	}
+
+	if errors.Is(err, ErrDrop) {
+		r.logger.Debug("REPLAY-RESOLVER: dropping query", zap.String("question", question.String()))
+		return nil, err
+	}
+	if err != nil {
+		r.logger.Error("REPLAY-RESOLVER: failed to build response",
+			zap.String("question", question.String()),
+			zap.Error(err),
+		)
+		return nil, err
+	}
 	if response != nil {
+		req.SetSource("replay")
 		r.logger.Debug(
 			"REPLAY-RESOLVER: replaying response",
-			zap.String("question", msg.Question[0].String()),
+			zap.String("question", question.String()),
 			zap.Strings("answer", AnswerStrings(response)),
 		)
 
 	} else {
-		r.logger.Debug("REPLAY-RESOLVER: no response found", zap.String("question", msg.Question[0].String()))
+		r.logger.Debug("REPLAY-RESOLVER: no response found", zap.String("question", question.String()))
 	}
 	return response, nil
 }
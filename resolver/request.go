@@ -0,0 +1,118 @@
+package resolver
+
+import (
+	"context"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// Request is a query along with what we know about the client that sent it
+type Request struct {
+	Msg *dns.Msg
+	// RemoteAddr is the address of the client, nil if not known
+	RemoteAddr net.Addr
+	// Protocol is the transport the query arrived on, "udp" or "tcp"
+	Protocol string
+
+	// source is the resolver that answered
+	source string
+}
+
+// NewRequest wraps a message that did not come from a client,
+// e.g. one built by a test.
+func NewRequest(msg *dns.Msg) *Request {
+	return &Request{Msg: msg}
+}
+
+// Question is the first question of the message
+func (r *Request) Question() dns.Question {
+	if r.Msg == nil || len(r.Msg.Question) == 0 {
+		return dns.Question{}
+	}
+	return r.Msg.Question[0]
+}
+
+// ClientIP is the IP address of the client, nil if not known
+func (r *Request) ClientIP() net.IP {
+	switch addr := r.RemoteAddr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// EDNS0 is the OPT record sent by the client, nil if there wasn't one
+func (r *Request) EDNS0() *dns.OPT {
+	if r.Msg == nil {
+		return nil
+	}
+	return r.Msg.IsEdns0()
+}
+
+// SetSource is called by a resolver answering the request, to say
+// where the answer came from, e.g. "replay" or "dns:8.8.8.8:53"
+func (r *Request) SetSource(source string) {
+	r.source = source
+}
+
+// Source is where the answer to the request came from, empty if
+// no resolver answered it
+func (r *Request) Source() string {
+	return r.source
+}
+
+// ClientSubnet is the network in the client's EDNS Client Subnet
+// option, nil if it didn't send one
+func (r *Request) ClientSubnet() *net.IPNet {
+	opt := r.EDNS0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		subnet, ok := o.(*dns.EDNS0_SUBNET)
+		if !ok {
+			continue
+		}
+		bits := 32
+		if subnet.Family == 2 {
+			bits = 128
+		}
+		mask := net.CIDRMask(int(subnet.SourceNetmask), bits)
+		if mask == nil {
+			return nil
+		}
+		return &net.IPNet{IP: subnet.Address.Mask(mask), Mask: mask}
+	}
+	return nil
+}
+
+// LegacyResolver is the original resolver interface, which has
+// no context or client information.
+type LegacyResolver interface {
+	Resolve(msg *dns.Msg) (*dns.Msg, error)
+}
+
+// FromLegacy adapts a LegacyResolver so it can be used as a Resolver
+func FromLegacy(r LegacyResolver) Resolver {
+	return &legacyResolver{resolver: r}
+}
+
+type legacyResolver struct {
+	resolver LegacyResolver
+}
+
+func (r *legacyResolver) ResolveContext(ctx context.Context, req *Request) (*dns.Msg, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r.resolver.Resolve(req.Msg)
+}
@@ -1,53 +1,115 @@
 package resolver
 
 import (
+	"context"
+	"strings"
+
 	"github.com/miekg/dns"
 	"github.com/shawnburke/dnsmock/config"
+	"github.com/shawnburke/dnsmock/metrics"
 	"github.com/shawnburke/dnsmock/spec"
 	"go.uber.org/zap"
 )
 
+// Resolver answers DNS requests.  A nil response with a nil
+// error means the resolver has no answer for the request.
 type Resolver interface {
-	Resolve(msg *dns.Msg) (*dns.Msg, error)
+	ResolveContext(ctx context.Context, req *Request) (*dns.Msg, error)
 }
 
 const DownstreamLocalhost = "localhost"
 const DownstreamNone = "none"
 
-func Build(cfg config.Parameters, s *spec.Responses, logger *zap.Logger) Resolver {
+// Build creates the resolvers the config asks for, recording metrics in m
+func Build(cfg config.Parameters, s *spec.Responses, m *metrics.Metrics, logger *zap.Logger) Resolver {
+	// in strict mode only the replay file answers, and
+	// anything it doesn't is unexpected
+	if cfg.Strict {
+		if s == nil {
+			s = spec.New()
+		}
+		return NewStrict(newReplay(s, m, logger), logger)
+	}
+
 	resolvers := []Resolver{}
 
-	// if we are replaying, add the replay resolver
-	if s != nil && s.Count() > 0 {
-		resolvers = append(resolvers, NewReplay(s, logger))
+	// if we are replaying, add the replay resolver, which the
+	// admin API may give rules to later if there are none now
+	if s != nil && (s.Count() > 0 || cfg.AdminAddr != "") {
+		resolvers = append(resolvers, newReplay(s, m, logger))
 	}
 
-	// if we have downstreams,
+	// if we have downstreams, those in the form "suffix=server"
+	// only get the queries for names under that suffix
 	ds := cfg.Downstreams()
+	downstreams := []Resolver{}
+	suffixes := []string{}
+	routed := map[string][]Resolver{}
 
-	if len(ds) > 0 {
-		for _, d := range ds {
-			var r Resolver
-			switch d {
-			case DownstreamNone:
-				continue
-			case DownstreamLocalhost:
-				r = NewLocal("", logger)
-			default:
-				resolvers = append(resolvers, NewDns(d, logger))
+	for _, d := range ds {
+		suffix, server, isRoute := strings.Cut(d, "=")
+		if !isRoute {
+			if r := buildDownstream(d, m, logger); r != nil {
+				downstreams = append(downstreams, r)
 			}
+			continue
+		}
+
+		suffix = strings.TrimSpace(suffix)
+		if _, ok := routed[suffix]; !ok {
+			suffixes = append(suffixes, suffix)
+			routed[suffix] = nil
+		}
+		if r := buildDownstream(strings.TrimSpace(server), m, logger); r != nil {
+			routed[suffix] = append(routed[suffix], r)
+		}
+	}
 
-			if r != nil {
-				resolvers = append(resolvers, r)
+	if len(suffixes) > 0 {
+		routes := []Route{}
+		for _, suffix := range suffixes {
+			route := Route{Suffix: suffix}
+			if len(routed[suffix]) > 0 {
+				route.Resolver = NewMulti(routed[suffix]...)
 			}
+			routes = append(routes, route)
 		}
+
+		var fallback Resolver
+		if len(downstreams) > 0 {
+			fallback = NewMulti(downstreams...)
+		}
+		downstreams = []Resolver{NewRouter(routes, fallback)}
+	}
+
+	// replay answers are cheap, so only cache what goes downstream
+	if cfg.CacheSize > 0 && len(downstreams) > 0 {
+		downstreams = []Resolver{NewCache(NewMulti(downstreams...), cfg.CacheSize, logger)}
 	}
-	all := NewMulti(resolvers...)
 
+	// only what goes downstream is recorded, as replayed
+	// answers come from the spec being recorded to
 	if cfg.Record {
-		all = NewRecorder(all, s, logger)
+		downstreams = []Resolver{newRecorder(NewMulti(downstreams...), s, m, logger)}
+	}
+
+	resolvers = append(resolvers, downstreams...)
+	return NewMulti(resolvers...)
+}
+
+// buildDownstream creates the resolver for a single downstream,
+// nil for DownstreamNone
+func buildDownstream(d string, m *metrics.Metrics, logger *zap.Logger) Resolver {
+	switch {
+	case d == DownstreamNone:
+		return nil
+	case d == DownstreamLocalhost:
+		return NewLocal("", logger)
+	case strings.HasPrefix(d, DownstreamHostsPrefix):
+		return NewHosts(strings.TrimPrefix(d, DownstreamHostsPrefix), logger)
+	default:
+		return newDns(d, m, logger)
 	}
-	return all
 }
 
 func AnswerStrings(response *dns.Msg) []string {
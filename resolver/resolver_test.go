@@ -1,7 +1,9 @@
 package resolver
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"os"
 	"path"
 	"strings"
@@ -9,7 +11,9 @@ import (
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/shawnburke/dnsmock/config"
+	"github.com/shawnburke/dnsmock/metrics"
 	"github.com/shawnburke/dnsmock/spec"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
@@ -32,11 +36,17 @@ func getFirstAnswer(res *dns.Msg, qtype uint16) dns.RR {
 }
 
 func fetch(t *testing.T, q *dns.Msg, r Resolver) dns.RR {
-	res, err := r.Resolve(q)
+	res, err := r.ResolveContext(context.Background(), NewRequest(q))
 	require.NoError(t, err)
 	return getFirstAnswer(res, q.Question[0].Qtype)
 }
 
+func mustSpec(t *testing.T, y string) *spec.Responses {
+	s, err := spec.FromYAML(y)
+	require.NoError(t, err)
+	return s
+}
+
 func TestDns(t *testing.T) {
 	r := NewDns("8.8.8.8", zap.NewNop())
 
@@ -53,6 +63,38 @@ func TestLocal(t *testing.T) {
 	require.NotNil(t, a)
 }
 
+func TestLocalNegative(t *testing.T) {
+	// resolv.conf servers are on port 53, so this needs to bind there
+	server := &dns.Server{Addr: "127.0.0.153:53", Net: "udp"}
+	server.Handler = dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetRcode(q, dns.RcodeNameError)
+		res.Ns = []dns.RR{spec.NegativeSOA(q.Question[0].Name)}
+		w.WriteMsg(res)
+	})
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	errs := make(chan error, 1)
+	go func() { errs <- server.ListenAndServe() }()
+	select {
+	case <-started:
+	case err := <-errs:
+		t.Skipf("can't listen on port 53: %v", err)
+	}
+	defer server.Shutdown()
+
+	conf := path.Join(t.TempDir(), "resolv.conf")
+	require.NoError(t, os.WriteFile(conf, []byte("nameserver 127.0.0.153\nsearch corp.test\n"), 0644))
+
+	req := NewRequest(makeQuestion("missing", dns.TypeA))
+	res, err := NewLocal(conf, zap.NewNop()).ResolveContext(context.Background(), req)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, res.Rcode)
+	require.Equal(t, "missing", res.Question[0].Name)
+	require.Len(t, res.Ns, 1)
+	require.Equal(t, "local", req.Source())
+}
+
 var specYaml = `
 rules:
  - name: google.com.
@@ -68,13 +110,17 @@ func TestReplay(t *testing.T) {
 	require.NoError(t, err)
 	defer os.Remove(filename)
 
-	s := spec.FromYAML(specYaml)
+	s := mustSpec(t, specYaml)
 	r := NewReplay(s, zap.NewNop())
 
 	testReplayCore(t, r)
 
-	r = NewReplayFromFile(filename, zap.NewNop())
+	r, err = NewReplayFromFile(filename, zap.NewNop())
+	require.NoError(t, err)
 	testReplayCore(t, r)
+
+	_, err = NewReplayFromFile(filename+".missing", zap.NewNop())
+	require.Error(t, err)
 }
 
 func testReplayCore(t *testing.T, r Resolver) {
@@ -90,18 +136,28 @@ func TestBuild(t *testing.T) {
 		record      bool
 		spec        *spec.Responses
 		downstreams string
+		cacheSize   int
+		adminAddr   string
+		strict      bool
 		expected    func(t *testing.T, r Resolver)
 	}{
 		{
 			record:      true,
-			spec:        spec.FromYAML(specYaml),
+			spec:        mustSpec(t, specYaml),
 			downstreams: "8.8.8.8,1.1.1.1:53",
 			expected: func(t *testing.T, r Resolver) {
-				require.IsType(t, &recorderResolver{}, r)
+				multi, ok := r.(*multiResolver)
+				require.True(t, ok)
+				require.Len(t, multi.resolvers, 2)
+
+				require.IsType(t, &replayResolver{}, multi.resolvers[0])
+				recorder, ok := multi.resolvers[1].(*recorderResolver)
+				require.True(t, ok)
+				require.Len(t, recorder.resolver.(*multiResolver).resolvers, 2)
 			},
 		},
 		{
-			spec:        spec.FromYAML(specYaml),
+			spec:        mustSpec(t, specYaml),
 			downstreams: "8.8.8.8,1.1.1.1:53",
 			expected: func(t *testing.T, r Resolver) {
 				multi, ok := r.(*multiResolver)
@@ -114,7 +170,7 @@ func TestBuild(t *testing.T) {
 			},
 		},
 		{
-			spec:        spec.FromYAML(specYaml),
+			spec:        mustSpec(t, specYaml),
 			downstreams: "none",
 			expected: func(t *testing.T, r Resolver) {
 				multi, ok := r.(*multiResolver)
@@ -126,7 +182,7 @@ func TestBuild(t *testing.T) {
 			},
 		},
 		{
-			spec:        spec.FromYAML(specYaml),
+			spec:        mustSpec(t, specYaml),
 			downstreams: "localhost",
 			expected: func(t *testing.T, r Resolver) {
 				multi, ok := r.(*multiResolver)
@@ -137,6 +193,88 @@ func TestBuild(t *testing.T) {
 				require.IsType(t, &localResolver{}, multi.resolvers[1])
 			},
 		},
+		{
+			// the admin API can add rules to an empty spec
+			spec:        spec.New(),
+			downstreams: "none",
+			adminAddr:   ":8053",
+			expected: func(t *testing.T, r Resolver) {
+				multi, ok := r.(*multiResolver)
+				require.True(t, ok)
+				require.Len(t, multi.resolvers, 1)
+				require.IsType(t, &replayResolver{}, multi.resolvers[0])
+			},
+		},
+		{
+			spec:        mustSpec(t, specYaml),
+			downstreams: "hosts:/etc/hosts,localhost",
+			expected: func(t *testing.T, r Resolver) {
+				multi, ok := r.(*multiResolver)
+				require.True(t, ok)
+				require.Len(t, multi.resolvers, 3)
+
+				require.IsType(t, &hostsResolver{}, multi.resolvers[1])
+				require.Equal(t, "/etc/hosts", multi.resolvers[1].(*hostsResolver).path)
+				require.IsType(t, &localResolver{}, multi.resolvers[2])
+			},
+		},
+		{
+			// strict mode only answers from the replay file
+			spec:        mustSpec(t, specYaml),
+			downstreams: "8.8.8.8",
+			strict:      true,
+			expected: func(t *testing.T, r Resolver) {
+				strict, ok := r.(*Strict)
+				require.True(t, ok)
+				require.IsType(t, &replayResolver{}, strict.resolver)
+			},
+		},
+		{
+			spec:        nil,
+			downstreams: "none",
+			strict:      true,
+			expected: func(t *testing.T, r Resolver) {
+				require.IsType(t, &Strict{}, r)
+			},
+		},
+		{
+			spec:        mustSpec(t, specYaml),
+			downstreams: "8.8.8.8,1.1.1.1:53",
+			cacheSize:   100,
+			expected: func(t *testing.T, r Resolver) {
+				multi, ok := r.(*multiResolver)
+				require.True(t, ok)
+				require.Len(t, multi.resolvers, 2)
+
+				require.IsType(t, &replayResolver{}, multi.resolvers[0])
+				cache, ok := multi.resolvers[1].(*cacheResolver)
+				require.True(t, ok)
+				require.Len(t, cache.next.(*multiResolver).resolvers, 2)
+			},
+		},
+		{
+			spec:        mustSpec(t, specYaml),
+			downstreams: "corp.internal.=10.0.0.2,*.svc.cluster.local=127.0.0.1:5353,corp.internal.=10.0.0.3,blocked.=none,8.8.8.8",
+			expected: func(t *testing.T, r Resolver) {
+				multi, ok := r.(*multiResolver)
+				require.True(t, ok)
+				require.Len(t, multi.resolvers, 2)
+
+				require.IsType(t, &replayResolver{}, multi.resolvers[0])
+				router, ok := multi.resolvers[1].(*routeResolver)
+				require.True(t, ok)
+				require.Len(t, router.routes, 3)
+				require.Len(t, router.fallback.(*multiResolver).resolvers, 1)
+
+				require.Equal(t, "svc.cluster.local.", router.routes[0].suffix)
+				require.True(t, router.routes[0].subdomainsOnly)
+				require.Equal(t, "127.0.0.1:5353", router.routes[0].resolver.(*multiResolver).resolvers[0].(*dnsResolver).server)
+				require.Equal(t, "corp.internal.", router.routes[1].suffix)
+				require.Len(t, router.routes[1].resolver.(*multiResolver).resolvers, 2)
+				require.Equal(t, "blocked.", router.routes[2].suffix)
+				require.Nil(t, router.routes[2].resolver)
+			},
+		},
 	}
 
 	for _, c := range cases {
@@ -144,8 +282,11 @@ func TestBuild(t *testing.T) {
 			cfg := config.Parameters{
 				Record:         c.record,
 				DownstreamsRaw: c.downstreams,
+				CacheSize:      c.cacheSize,
+				AdminAddr:      c.adminAddr,
+				Strict:         c.strict,
 			}
-			r := Build(cfg, c.spec, zap.NewNop())
+			r := Build(cfg, c.spec, metrics.New(nil), zap.NewNop())
 			require.NotNil(t, r)
 
 			c.expected(t, r)
@@ -158,7 +299,7 @@ func TestBuild(t *testing.T) {
 func TestRecorder(t *testing.T) {
 	s2 := spec.New()
 
-	rs := spec.FromYAML(specYaml)
+	rs := mustSpec(t, specYaml)
 	resolver := NewReplay(rs, zap.NewNop())
 	r := NewRecorder(resolver, s2, zap.NewNop())
 
@@ -169,7 +310,8 @@ func TestRecorder(t *testing.T) {
 	require.Equal(t, "4.3.2.1", ar.A.String())
 
 	require.Len(t, s2.Rules, 1)
-	res := s2.Find(q)
+	res, err := s2.Find(q)
+	require.NoError(t, err)
 	require.NotNil(t, res)
 	a = getFirstAnswer(res, q.Question[0].Qtype)
 	require.NotNil(t, a)
@@ -178,6 +320,31 @@ func TestRecorder(t *testing.T) {
 
 }
 
+func TestRecorderOrder(t *testing.T) {
+	upstream := &dns.Msg{}
+	upstream.Answer = []dns.RR{
+		mustRR(t, "rr.test. 60 IN A 10.0.0.1"),
+		mustRR(t, "rr.test. 60 IN A 10.0.0.2"),
+	}
+	next := &countingResolver{responses: map[string]*dns.Msg{"rr.test.": upstream}}
+
+	s := mustSpec(t, `
+rules:
+  - name: "rr.test."
+    order: round_robin
+`)
+	r := NewRecorder(next, s, zap.NewNop())
+
+	first := []string{}
+	for i := 0; i < 2; i++ {
+		res := mustResolve(t, r, "rr.test.")
+		first = append(first, res.Answer[0].(*dns.A).A.String())
+	}
+	require.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, first)
+	require.Len(t, s.Rules, 1)
+	require.Len(t, s.Rules[0].Records["A"], 2)
+}
+
 func TestMulti(t *testing.T) {
 	r1 := NewLocal("", zap.NewNop())
 	r2 := NewLocal("", zap.NewNop())
@@ -189,3 +356,515 @@ func TestMulti(t *testing.T) {
 	require.NotNil(t, a)
 
 }
+
+type legacyReplay struct {
+	s *spec.Responses
+}
+
+func (r legacyReplay) Resolve(msg *dns.Msg) (*dns.Msg, error) {
+	return r.s.Find(msg)
+}
+
+func TestFromLegacy(t *testing.T) {
+	r := NewMulti(FromLegacy(legacyReplay{s: mustSpec(t, specYaml)}))
+	testReplayCore(t, r)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := r.ResolveContext(ctx, NewRequest(makeQuestion("google.com.", dns.TypeA)))
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestRequest(t *testing.T) {
+	q := makeQuestion("google.com.", dns.TypeA)
+	q.SetEdns0(4096, false)
+
+	req := &Request{
+		Msg:        q,
+		RemoteAddr: &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5353},
+		Protocol:   "udp",
+	}
+	require.Equal(t, "10.1.2.3", req.ClientIP().String())
+	require.Equal(t, "google.com.", req.Question().Name)
+	require.Equal(t, uint16(4096), req.EDNS0().UDPSize())
+
+	require.Nil(t, req.ClientSubnet())
+
+	req = NewRequest(makeQuestion("google.com.", dns.TypeA))
+	require.Nil(t, req.ClientIP())
+	require.Nil(t, req.EDNS0())
+	require.Nil(t, req.ClientSubnet())
+
+	req = NewRequest(withSubnet(makeQuestion("google.com.", dns.TypeA), "198.51.100.77", 24))
+	require.Equal(t, "198.51.100.0/24", req.ClientSubnet().String())
+}
+
+// withSubnet adds an EDNS Client Subnet option to a query
+func withSubnet(q *dns.Msg, ip string, bits uint8) *dns.Msg {
+	q.SetEdns0(4096, false)
+	opt := q.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: bits,
+		Address:       net.ParseIP(ip),
+	})
+	return q
+}
+
+func TestReplayViews(t *testing.T) {
+	s := mustSpec(t, `
+rules:
+  - name: "geo.test."
+    client_subnets: ["198.51.100.0/24"]
+    records:
+      A: ["geo.test. 60 IN A 10.0.0.1"]
+  - name: "geo.test."
+    clients: ["10.1.0.0/16"]
+    records:
+      A: ["geo.test. 60 IN A 10.0.0.2"]
+  - name: "geo.test."
+    records:
+      A: ["geo.test. 60 IN A 10.0.0.3"]
+`)
+	r := NewReplay(s, zap.NewNop())
+
+	resolve := func(req *Request) string {
+		res, err := r.ResolveContext(context.Background(), req)
+		require.NoError(t, err)
+		return res.Answer[0].(*dns.A).A.String()
+	}
+
+	remote := &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5353}
+	require.Equal(t, "10.0.0.2", resolve(&Request{Msg: makeQuestion("geo.test.", dns.TypeA), RemoteAddr: remote}))
+	require.Equal(t, "10.0.0.1", resolve(&Request{
+		Msg:        withSubnet(makeQuestion("geo.test.", dns.TypeA), "198.51.100.7", 24),
+		RemoteAddr: remote,
+	}))
+	require.Equal(t, "10.0.0.3", resolve(NewRequest(makeQuestion("geo.test.", dns.TypeA))))
+}
+
+// countingResolver answers from a fixed set of responses, counting the
+// calls it gets
+type countingResolver struct {
+	calls     int
+	responses map[string]*dns.Msg
+	// fallback answers names not in responses
+	fallback *dns.Msg
+}
+
+func (r *countingResolver) ResolveContext(ctx context.Context, req *Request) (*dns.Msg, error) {
+	r.calls++
+	response := r.responses[req.Question().Name]
+	if response == nil {
+		response = r.fallback
+	}
+	if response == nil {
+		return nil, nil
+	}
+	response = response.Copy()
+	response.SetRcode(req.Msg, response.Rcode)
+	return response, nil
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	require.NoError(t, err)
+	return rr
+}
+
+func TestCache(t *testing.T) {
+	positive := &dns.Msg{}
+	positive.Answer = []dns.RR{
+		mustRR(t, "a.test. 300 IN A 1.2.3.4"),
+		mustRR(t, "a.test. 60 IN A 1.2.3.5"),
+	}
+
+	negative := &dns.Msg{}
+	negative.Rcode = dns.RcodeNameError
+	negative.Ns = []dns.RR{mustRR(t, "test. 3600 IN SOA ns.test. host.test. 1 3600 600 86400 30")}
+
+	failed := &dns.Msg{}
+	failed.Rcode = dns.RcodeServerFailure
+
+	next := &countingResolver{responses: map[string]*dns.Msg{
+		"a.test.":    positive,
+		"none.test.": negative,
+		"fail.test.": failed,
+	}}
+
+	now := time.Now()
+	r := NewCache(next, 10, zap.NewNop()).(*cacheResolver)
+	r.now = func() time.Time { return now }
+
+	resolve := func(name string) *dns.Msg {
+		res, err := r.ResolveContext(context.Background(), NewRequest(makeQuestion(name, dns.TypeA)))
+		require.NoError(t, err)
+		return res
+	}
+
+	// answers are cached until the lowest TTL runs out
+	resolve("a.test.")
+	require.Equal(t, 1, next.calls)
+
+	now = now.Add(10 * time.Second)
+	res := resolve("A.Test.")
+	require.Equal(t, 1, next.calls)
+	require.Len(t, res.Answer, 2)
+	require.Equal(t, uint32(290), res.Answer[0].Header().Ttl)
+	require.Equal(t, uint32(50), res.Answer[1].Header().Ttl)
+
+	now = now.Add(50 * time.Second)
+	resolve("a.test.")
+	require.Equal(t, 2, next.calls)
+
+	// negative answers use the SOA minimum
+	res = resolve("none.test.")
+	require.Equal(t, dns.RcodeNameError, res.Rcode)
+	resolve("none.test.")
+	require.Equal(t, 3, next.calls)
+
+	now = now.Add(30 * time.Second)
+	resolve("none.test.")
+	require.Equal(t, 4, next.calls)
+
+	// failures and misses are not cached
+	resolve("fail.test.")
+	resolve("fail.test.")
+	require.Nil(t, resolve("missing.test."))
+	require.Nil(t, resolve("missing.test."))
+	require.Equal(t, 8, next.calls)
+}
+
+func TestCacheEviction(t *testing.T) {
+	next := &countingResolver{responses: map[string]*dns.Msg{}}
+	for _, name := range []string{"a.test.", "b.test.", "c.test."} {
+		m := &dns.Msg{}
+		m.Answer = []dns.RR{mustRR(t, name+" 300 IN A 1.2.3.4")}
+		next.responses[name] = m
+	}
+
+	r := NewCache(next, 2, zap.NewNop())
+	resolve := func(name string) {
+		_, err := r.ResolveContext(context.Background(), NewRequest(makeQuestion(name, dns.TypeA)))
+		require.NoError(t, err)
+	}
+
+	resolve("a.test.")
+	resolve("b.test.")
+	resolve("a.test.") // a is now more recent than b
+	require.Equal(t, 2, next.calls)
+
+	resolve("c.test.") // evicts b
+	resolve("a.test.")
+	require.Equal(t, 3, next.calls)
+
+	resolve("b.test.")
+	require.Equal(t, 4, next.calls)
+}
+
+func TestRouter(t *testing.T) {
+	answer := func(ip string) *countingResolver {
+		m := &dns.Msg{}
+		m.Answer = []dns.RR{mustRR(t, "answer.test. 300 IN A "+ip)}
+		return &countingResolver{responses: map[string]*dns.Msg{}, fallback: m}
+	}
+
+	corp := answer("10.0.0.1")
+	deep := answer("10.0.0.2")
+	svc := answer("10.0.0.3")
+	fallback := answer("8.8.8.8")
+
+	r := NewRouter([]Route{
+		{Suffix: "corp.internal", Resolver: corp},
+		{Suffix: "*.svc.cluster.local.", Resolver: svc},
+		{Suffix: "deep.corp.internal.", Resolver: deep},
+		{Suffix: "blocked.test.", Resolver: nil},
+	}, fallback)
+
+	cases := map[string]string{
+		"corp.internal.":         "10.0.0.1",
+		"Host.Corp.Internal.":    "10.0.0.1",
+		"a.deep.corp.internal.":  "10.0.0.2",
+		"deep.corp.internal.":    "10.0.0.2",
+		"api.svc.cluster.local.": "10.0.0.3",
+		"svc.cluster.local.":     "8.8.8.8",
+		"notcorp.internal.":      "8.8.8.8",
+		"google.com.":            "8.8.8.8",
+		"blocked.test.":          "",
+		"really.blocked.test.":   "",
+	}
+
+	for name, expected := range cases {
+		res, err := r.ResolveContext(context.Background(), NewRequest(makeQuestion(name, dns.TypeA)))
+		require.NoError(t, err, name)
+		if expected == "" {
+			require.Nil(t, res, name)
+			continue
+		}
+		require.Equal(t, expected, res.Answer[0].(*dns.A).A.String(), name)
+	}
+
+	require.Nil(t, mustResolve(t, NewRouter(nil, nil), "google.com."))
+}
+
+func mustResolve(t *testing.T, r Resolver, name string) *dns.Msg {
+	res, err := r.ResolveContext(context.Background(), NewRequest(makeQuestion(name, dns.TypeA)))
+	require.NoError(t, err)
+	return res
+}
+
+func TestMultiNegative(t *testing.T) {
+	s := mustSpec(t, `
+rules:
+ - name: gone.test.
+   rcode: NXDOMAIN
+ - name: v4.test.
+   records:
+    A:
+    - "v4.test. 300 IN A 4.3.2.1"
+    TXT: []
+`)
+	next := &countingResolver{responses: map[string]*dns.Msg{}}
+	r := NewMulti(NewReplay(s, zap.NewNop()), next)
+
+	// negative answers from the replay settle the query
+	res := mustResolve(t, r, "gone.test.")
+	require.Equal(t, dns.RcodeNameError, res.Rcode)
+
+	res, err := r.ResolveContext(context.Background(), NewRequest(makeQuestion("v4.test.", dns.TypeTXT)))
+	require.NoError(t, err)
+	require.Empty(t, res.Answer)
+	require.Len(t, res.Ns, 1)
+	require.Equal(t, 0, next.calls)
+
+	// but no rule for the type falls through
+	res, err = r.ResolveContext(context.Background(), NewRequest(makeQuestion("v4.test.", dns.TypeAAAA)))
+	require.NoError(t, err)
+	require.Nil(t, res)
+	require.Equal(t, 1, next.calls)
+}
+
+func TestMultiDrop(t *testing.T) {
+	s := mustSpec(t, `
+rules:
+  - name: "lost.test."
+    drop: 1
+    records:
+      A: ["lost.test. 60 IN A 10.0.0.1"]
+`)
+	next := &countingResolver{fallback: &dns.Msg{Answer: []dns.RR{mustRR(t, "lost.test. 60 IN A 10.0.0.2")}}}
+	r := NewMulti(NewReplay(s, zap.NewNop()), next)
+
+	_, err := r.ResolveContext(context.Background(), NewRequest(makeQuestion("lost.test.", dns.TypeA)))
+	require.ErrorIs(t, err, ErrDrop)
+	require.Zero(t, next.calls)
+}
+
+func TestHosts(t *testing.T) {
+	file := path.Join(t.TempDir(), "hosts")
+	err := os.WriteFile(file, []byte(`# local names
+127.0.0.1   localhost
+10.0.0.5    db.test db   # the database
+10.0.0.6    db.test
+fd00::5     db.test
+fe80::1%lo0 link.test
+not-an-ip   bad.test
+`), 0644)
+	require.NoError(t, err)
+
+	r := NewHosts(file, zap.NewNop())
+	resolve := func(name string, qtype uint16) *dns.Msg {
+		res, err := r.ResolveContext(context.Background(), NewRequest(makeQuestion(name, qtype)))
+		require.NoError(t, err)
+		return res
+	}
+
+	res := resolve("DB.test.", dns.TypeA)
+	require.Len(t, res.Answer, 2)
+	require.Equal(t, "10.0.0.5", res.Answer[0].(*dns.A).A.String())
+	require.Equal(t, "DB.test.", res.Answer[0].Header().Name)
+	require.Equal(t, uint32(HostsTTL), res.Answer[0].Header().Ttl)
+
+	require.Len(t, resolve("db.", dns.TypeA).Answer, 1)
+	require.Equal(t, "fd00::5", resolve("db.test.", dns.TypeAAAA).Answer[0].(*dns.AAAA).AAAA.String())
+	require.Len(t, resolve("link.test.", dns.TypeAAAA).Answer, 1)
+	require.Nil(t, resolve("localhost.", dns.TypeAAAA))
+	require.Nil(t, resolve("bad.test.", dns.TypeA))
+	require.Nil(t, resolve("db.test.", dns.TypeMX))
+
+	res = resolve("5.0.0.10.in-addr.arpa.", dns.TypePTR)
+	require.Equal(t, "db.test.", res.Answer[0].(*dns.PTR).Ptr)
+
+	// changes are picked up
+	require.NoError(t, os.WriteFile(file, []byte("10.0.0.7 db.test\n"), 0644))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(file, later, later))
+	res = resolve("db.test.", dns.TypeA)
+	require.Len(t, res.Answer, 1)
+	require.Equal(t, "10.0.0.7", res.Answer[0].(*dns.A).A.String())
+
+	_, err = NewHosts(path.Join(t.TempDir(), "missing"), zap.NewNop()).
+		ResolveContext(context.Background(), NewRequest(makeQuestion("db.test.", dns.TypeA)))
+	require.Error(t, err)
+}
+
+func TestSource(t *testing.T) {
+	s := mustSpec(t, specYaml)
+	next := &countingResolver{fallback: &dns.Msg{Answer: []dns.RR{mustRR(t, "other.test. 60 IN A 10.0.0.2")}}}
+	r := NewMulti(NewReplay(s, zap.NewNop()), NewCache(next, 10, zap.NewNop()))
+
+	source := func(name string) string {
+		req := NewRequest(makeQuestion(name, dns.TypeA))
+		_, err := r.ResolveContext(context.Background(), req)
+		require.NoError(t, err)
+		return req.Source()
+	}
+
+	require.Equal(t, "replay", source("google.com."))
+	// the counting resolver doesn't say, so it's unknown, then cached
+	require.Equal(t, "", source("other.test."))
+	require.Equal(t, "cache", source("other.test."))
+}
+
+func TestStrict(t *testing.T) {
+	s := mustSpec(t, `
+rules:
+  - name: "api.test."
+    records:
+      A: ["api.test. 60 IN A 10.0.0.1"]
+  - name: "lost.test."
+    drop: 1
+    records:
+      A: ["lost.test. 60 IN A 10.0.0.2"]
+`)
+	r := NewStrict(NewReplay(s, zap.NewNop()), zap.NewNop())
+	resolve := func(name string, qtype uint16) (*dns.Msg, error) {
+		req := NewRequest(makeQuestion(name, qtype))
+		req.RemoteAddr = &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 4000}
+		return r.ResolveContext(context.Background(), req)
+	}
+
+	res, err := resolve("api.test.", dns.TypeA)
+	require.NoError(t, err)
+	require.Len(t, res.Answer, 1)
+
+	_, err = resolve("lost.test.", dns.TypeA)
+	require.ErrorIs(t, err, ErrDrop)
+	require.Empty(t, r.Unexpected())
+
+	_, err = resolve("other.test.", dns.TypeA)
+	require.Error(t, err)
+	require.Equal(t, dns.RcodeRefused, Rcode(err))
+	resolve("OTHER.test.", dns.TypeA)
+	resolve("api.test.", dns.TypeMX)
+
+	unexpected := r.Unexpected()
+	require.Len(t, unexpected, 2)
+	require.Equal(t, "other.test.", unexpected[0].Name)
+	require.Equal(t, "A", unexpected[0].Type)
+	require.Equal(t, "10.1.2.3:4000", unexpected[0].Client)
+	require.Equal(t, 2, unexpected[0].Count)
+	require.Equal(t, "other.test. A from 10.1.2.3:4000 (2 times)", unexpected[0].String())
+	require.Equal(t, "api.test. MX from 10.1.2.3:4000", unexpected[1].String())
+
+	r.Reset()
+	require.Empty(t, r.Unexpected())
+}
+
+func TestRecordReplayOrder(t *testing.T) {
+	s := mustSpec(t, `
+rules:
+  - name: "rr.test."
+    order: round_robin
+    records:
+      A:
+        - "rr.test. 60 IN A 10.0.0.1"
+        - "rr.test. 60 IN A 10.0.0.2"
+        - "rr.test. 60 IN A 10.0.0.3"
+`)
+	m := metrics.New(nil)
+	r := Build(config.Parameters{Record: true, DownstreamsRaw: DownstreamNone}, s, m, zap.NewNop())
+
+	first := []string{}
+	for i := 0; i < 4; i++ {
+		res := mustResolve(t, r, "rr.test.")
+		first = append(first, res.Answer[0].(*dns.A).A.String())
+	}
+	require.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.1"}, first)
+	require.Equal(t, float64(4), testutil.ToFloat64(m.ReplayLookups.WithLabelValues("hit")))
+
+	// replayed answers were arranged by the spec they came
+	// from, so a recorder leaves them as they are
+	from := mustSpec(t, `
+rules:
+  - name: "rr.test."
+    records:
+      A: ["rr.test. 60 IN A 10.0.0.1", "rr.test. 60 IN A 10.0.0.2"]
+`)
+	to := mustSpec(t, `
+rules:
+  - name: "rr.test."
+    order: round_robin
+`)
+	r = NewRecorder(NewReplay(from, zap.NewNop()), to, zap.NewNop())
+	for i := 0; i < 2; i++ {
+		res := mustResolve(t, r, "rr.test.")
+		require.Equal(t, "10.0.0.1", res.Answer[0].(*dns.A).A.String())
+	}
+}
+
+func TestRecorderNegative(t *testing.T) {
+	nxdomain := &dns.Msg{}
+	nxdomain.Rcode = dns.RcodeNameError
+	nxdomain.Ns = []dns.RR{mustRR(t, "test. 300 IN SOA ns.test. admin.test. 1 3600 600 86400 300")}
+	nodata := &dns.Msg{}
+	nodata.Ns = nxdomain.Ns
+	next := &countingResolver{responses: map[string]*dns.Msg{
+		"missing.test.": nxdomain,
+		"api.test.":     nodata,
+	}}
+
+	s := spec.New()
+	r := NewRecorder(next, s, zap.NewNop())
+	for _, q := range []*dns.Msg{makeQuestion("missing.test.", dns.TypeA), makeQuestion("api.test.", dns.TypeAAAA)} {
+		res, err := r.ResolveContext(context.Background(), NewRequest(q))
+		require.NoError(t, err)
+		require.NotNil(t, res)
+	}
+	require.Len(t, s.Rules, 2)
+
+	// the recording replays the same negative answers
+	y, err := s.YAML()
+	require.NoError(t, err)
+	replay := NewReplay(mustSpec(t, y), zap.NewNop())
+
+	res, err := replay.ResolveContext(context.Background(), NewRequest(makeQuestion("missing.test.", dns.TypeA)))
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, res.Rcode)
+	require.Empty(t, res.Answer)
+	require.Len(t, res.Ns, 1)
+	require.Equal(t, "ns.test.", res.Ns[0].(*dns.SOA).Ns)
+
+	res, err = replay.ResolveContext(context.Background(), NewRequest(makeQuestion("api.test.", dns.TypeAAAA)))
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, res.Rcode)
+	require.Empty(t, res.Answer)
+	require.Equal(t, "ns.test.", res.Ns[0].(*dns.SOA).Ns)
+
+	// a later positive answer replaces the negative one
+	next.responses["api.test."] = &dns.Msg{Answer: []dns.RR{mustRR(t, "api.test. 60 IN AAAA ::1")}}
+	_, err = r.ResolveContext(context.Background(), NewRequest(makeQuestion("api.test.", dns.TypeAAAA)))
+	require.NoError(t, err)
+	res, err = s.Find(makeQuestion("api.test.", dns.TypeAAAA))
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, res.Rcode)
+	require.Len(t, res.Answer, 1)
+	require.Empty(t, res.Ns)
+}
+
+func TestReplayNoQuestion(t *testing.T) {
+	r := NewRecorder(NewReplay(mustSpec(t, specYaml), zap.NewNop()), spec.New(), zap.NewNop())
+	_, err := r.ResolveContext(context.Background(), NewRequest(&dns.Msg{}))
+	require.ErrorIs(t, err, spec.ErrNoQuestion)
+}
@@ -0,0 +1,78 @@
+package resolver
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Route forwards queries for names under a domain suffix to a resolver.
+// A suffix like "corp.internal." matches that name and any name under it,
+// while "*.svc.cluster.local." only matches names under it.
+type Route struct {
+	Suffix   string
+	Resolver Resolver
+}
+
+// NewRouter creates a resolver that forwards each query to the
+// resolver of the most specific route matching its name, or to
+// fallback if none match.  Either may be nil, meaning no answer.
+func NewRouter(routes []Route, fallback Resolver) Resolver {
+	r := &routeResolver{fallback: fallback}
+
+	for _, route := range routes {
+		suffix := dns.CanonicalName(route.Suffix)
+		subdomainsOnly := strings.HasPrefix(suffix, "*.")
+		if subdomainsOnly {
+			suffix = suffix[2:]
+		}
+		r.routes = append(r.routes, compiledRoute{
+			suffix:         suffix,
+			subdomainsOnly: subdomainsOnly,
+			resolver:       route.Resolver,
+		})
+	}
+
+	// most specific first, keeping the given order for equals
+	sort.SliceStable(r.routes, func(i, j int) bool {
+		return dns.CountLabel(r.routes[i].suffix) > dns.CountLabel(r.routes[j].suffix)
+	})
+	return r
+}
+
+type compiledRoute struct {
+	suffix         string
+	subdomainsOnly bool
+	resolver       Resolver
+}
+
+func (c compiledRoute) matches(name string) bool {
+	if name == c.suffix {
+		return !c.subdomainsOnly
+	}
+	return c.suffix == "." || strings.HasSuffix(name, "."+c.suffix)
+}
+
+type routeResolver struct {
+	routes   []compiledRoute
+	fallback Resolver
+}
+
+func (r *routeResolver) ResolveContext(ctx context.Context, req *Request) (*dns.Msg, error) {
+	resolver := r.fallback
+
+	name := dns.CanonicalName(req.Question().Name)
+	for _, route := range r.routes {
+		if route.matches(name) {
+			resolver = route.resolver
+			break
+		}
+	}
+
+	if resolver == nil {
+		return nil, nil
+	}
+	return resolver.ResolveContext(ctx, req)
+}
@@ -0,0 +1,110 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// UnexpectedQuery is a query a strict resolver had no answer for
+type UnexpectedQuery struct {
+	Name string
+	Type string
+	// Client is the address of the first client to ask, if known
+	Client string
+	// First is when it was first asked
+	First time.Time
+	// Count is how many times it was asked
+	Count int
+}
+
+func (u UnexpectedQuery) String() string {
+	s := fmt.Sprintf("%s %s", u.Name, u.Type)
+	if u.Client != "" {
+		s += " from " + u.Client
+	}
+	if u.Count > 1 {
+		s += fmt.Sprintf(" (%d times)", u.Count)
+	}
+	return s
+}
+
+// Strict is a resolver that refuses the queries another resolver has no
+// answer for, and keeps a list of them, e.g. so a test can fail when the
+// code under test looks up a name that wasn't mocked.
+type Strict struct {
+	sync.Mutex
+	resolver   Resolver
+	logger     *zap.Logger
+	unexpected []*UnexpectedQuery
+	index      map[string]*UnexpectedQuery
+}
+
+// NewStrict wraps r so that queries it doesn't answer are answered
+// REFUSED and recorded as unexpected
+func NewStrict(r Resolver, logger *zap.Logger) *Strict {
+	return &Strict{
+		resolver: r,
+		logger:   logger.With(zap.String("resolver", "strict")),
+		index:    map[string]*UnexpectedQuery{},
+	}
+}
+
+func (s *Strict) ResolveContext(ctx context.Context, req *Request) (*dns.Msg, error) {
+	response, err := s.resolver.ResolveContext(ctx, req)
+	if err != nil || response != nil {
+		return response, err
+	}
+
+	q := req.Question()
+	s.logger.Warn("STRICT-RESOLVER: unexpected query", zap.String("question", q.String()))
+	s.record(req)
+	return nil, &RcodeError{Rcode: dns.RcodeRefused, Err: errors.New("unexpected query")}
+}
+
+func (s *Strict) record(req *Request) {
+	q := req.Question()
+	name, qtype := dns.CanonicalName(q.Name), dns.TypeToString[q.Qtype]
+	key := name + " " + qtype
+
+	s.Lock()
+	defer s.Unlock()
+
+	if u, ok := s.index[key]; ok {
+		u.Count++
+		return
+	}
+
+	u := &UnexpectedQuery{Name: name, Type: qtype, First: time.Now(), Count: 1}
+	if req.RemoteAddr != nil {
+		u.Client = req.RemoteAddr.String()
+	}
+	s.unexpected = append(s.unexpected, u)
+	s.index[key] = u
+}
+
+// Unexpected lists the queries that had no answer, by name and
+// type, in the order they were first asked
+func (s *Strict) Unexpected() []UnexpectedQuery {
+	s.Lock()
+	defer s.Unlock()
+
+	all := []UnexpectedQuery{}
+	for _, u := range s.unexpected {
+		all = append(all, *u)
+	}
+	return all
+}
+
+// Reset forgets the unexpected queries so far
+func (s *Strict) Reset() {
+	s.Lock()
+	defer s.Unlock()
+	s.unexpected = nil
+	s.index = map[string]*UnexpectedQuery{}
+}
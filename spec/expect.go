@@ -0,0 +1,184 @@
+package spec
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// TestingT is the part of *testing.T that Verify needs
+type TestingT interface {
+	Errorf(format string, args ...interface{})
+}
+
+// Expectation is how many times a test expects a name to be looked
+// up, made by Expect.  By default it is at least once.
+type Expectation struct {
+	name  string
+	qtype uint16
+	// suffix is set for names like "*.example.com.", which
+	// match anything under example.com.
+	suffix  string
+	pattern *regexp.Regexp
+	// min and max are the bounds on the count, max -1 for none
+	min   int
+	max   int
+	count atomic.Uint64
+}
+
+// Expect expects queries for a name and type from now on, dns.TypeNone
+// for any type.  A leading "*." matches any name under the rest, as in
+// rules, and other "*" and "?" wildcards match as in MatchGlob.  Check
+// expectations with Verify.
+func (r *Responses) Expect(name string, qtype uint16) *Expectation {
+	e := &Expectation{name: normalizeName(name), qtype: qtype, min: 1, max: -1}
+	switch {
+	case strings.HasPrefix(e.name, "*.") && !strings.ContainsAny(e.name[2:], "*?"):
+		e.suffix = e.name[1:]
+	case strings.ContainsAny(e.name, "*?"):
+		// only wildcards are special, so this always compiles
+		e.pattern = regexp.MustCompile("^" + globToRegex(e.name) + "$")
+	}
+
+	r.expectMu.Lock()
+	defer r.expectMu.Unlock()
+	r.expectations = append(r.expectations, e)
+	return e
+}
+
+// Times expects exactly n queries
+func (e *Expectation) Times(n int) *Expectation {
+	e.min, e.max = n, n
+	return e
+}
+
+// Never expects no queries at all
+func (e *Expectation) Never() *Expectation {
+	return e.Times(0)
+}
+
+// AtLeast expects n or more queries
+func (e *Expectation) AtLeast(n int) *Expectation {
+	e.min, e.max = n, -1
+	return e
+}
+
+// AtMost expects no more than n queries
+func (e *Expectation) AtMost(n int) *Expectation {
+	e.min, e.max = 0, n
+	return e
+}
+
+// Count is how many matching queries there have been
+func (e *Expectation) Count() int {
+	return int(e.count.Load())
+}
+
+// matches reports whether a query is one the expectation is for
+func (e *Expectation) matches(name string, qtype uint16) bool {
+	if e.qtype != dns.TypeNone && e.qtype != qtype {
+		return false
+	}
+	switch {
+	case e.suffix != "":
+		return strings.HasSuffix(name, e.suffix)
+	case e.pattern != nil:
+		return e.pattern.MatchString(name)
+	}
+	return name == e.name
+}
+
+// met reports whether the count is within bounds
+func (e *Expectation) met() bool {
+	n := e.Count()
+	return n >= e.min && (e.max < 0 || n <= e.max)
+}
+
+func (e *Expectation) String() string {
+	qtype := "queries"
+	if e.qtype != dns.TypeNone {
+		qtype = dns.TypeToString[e.qtype] + " queries"
+	}
+
+	var times string
+	switch {
+	case e.max == 0:
+		times = "never"
+	case e.min == e.max:
+		times = fmt.Sprintf("exactly %s", plural(e.min))
+	case e.max < 0:
+		times = fmt.Sprintf("at least %s", plural(e.min))
+	case e.min == 0:
+		times = fmt.Sprintf("at most %s", plural(e.max))
+	default:
+		times = fmt.Sprintf("%d to %d times", e.min, e.max)
+	}
+	return fmt.Sprintf("%s for %s %s", qtype, e.name, times)
+}
+
+func plural(n int) string {
+	if n == 1 {
+		return "once"
+	}
+	return fmt.Sprintf("%d times", n)
+}
+
+// expected counts a query against the expectations it matches
+func (r *Responses) expected(question dns.Question) {
+	r.expectMu.Lock()
+	defer r.expectMu.Unlock()
+
+	name := normalizeName(question.Name)
+	for _, e := range r.expectations {
+		if e.matches(name, question.Qtype) {
+			e.count.Add(1)
+		}
+	}
+}
+
+// Verify fails t for every expectation not met, and for every rule
+// that has not answered a query, unless it is optional.
+func (r *Responses) Verify(t TestingT) {
+	if h, ok := t.(interface{ Helper() }); ok {
+		h.Helper()
+	}
+	for _, problem := range r.problems() {
+		t.Errorf("%s", problem)
+	}
+}
+
+// problems describes the unmet expectations, then the rules never hit
+func (r *Responses) problems() []string {
+	problems := []string{}
+
+	r.expectMu.Lock()
+	for _, e := range r.expectations {
+		if !e.met() {
+			problems = append(problems, fmt.Sprintf("expected %s, got %d", e, e.Count()))
+		}
+	}
+	r.expectMu.Unlock()
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, rule := range r.Rules {
+		if rule.Optional || rule.Hits() > 0 {
+			continue
+		}
+		where := fmt.Sprintf("rule %q", rule.Name)
+		if rule.line > 0 {
+			where += fmt.Sprintf(" (line %d)", rule.line)
+		}
+		problems = append(problems, where+" was never hit")
+	}
+	return problems
+}
+
+// Hits is how many queries the rule has answered, or
+// dropped, since it was loaded or reset
+func (rule *Rule) Hits() uint64 {
+	return rule.hits.Load()
+}
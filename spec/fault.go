@@ -0,0 +1,92 @@
+package spec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ErrDrop is returned for a query a rule drops, which
+// should get no response at all.
+var ErrDrop = errors.New("query dropped")
+
+// Faults make a rule misbehave, to test how clients cope
+// with slow or unreliable DNS.
+type Faults struct {
+	// Delay is how long to wait before replying, e.g. "250ms"
+	Delay time.Duration `yaml:"delay,omitempty"`
+	// Jitter adds up to this much more delay at random
+	Jitter time.Duration `yaml:"jitter,omitempty"`
+	// Drop is the chance, from 0 to 1, of not replying at all
+	Drop float64 `yaml:"drop,omitempty"`
+	// Error is the chance, from 0 to 1, of replying SERVFAIL
+	Error float64 `yaml:"error,omitempty"`
+}
+
+// checkFaults checks the rule's fault settings
+func (rc *ruleCompiler) checkFaults() {
+	f := rc.rule.Faults
+	if f.Delay < 0 {
+		rc.fail("", "delay", fmt.Errorf("negative delay %v", f.Delay))
+	}
+	if f.Jitter < 0 {
+		rc.fail("", "jitter", fmt.Errorf("negative jitter %v", f.Jitter))
+	}
+	if f.Drop < 0 || f.Drop > 1 {
+		rc.fail("", "drop", fmt.Errorf("drop %v is not between 0 and 1", f.Drop))
+	}
+	if f.Error < 0 || f.Error > 1 {
+		rc.fail("", "error", fmt.Errorf("error %v is not between 0 and 1", f.Error))
+	}
+}
+
+// fault decides what happens to a query: how long to wait before
+// replying, and whether to drop it or fail it instead.
+func (rule *Rule) fault() (delay time.Duration, drop bool, fail bool) {
+	f := rule.Faults
+	if f.Jitter == 0 && f.Drop == 0 && f.Error == 0 {
+		return f.Delay, false, false
+	}
+
+	rule.random(func(rng *rand.Rand) {
+		delay = f.Delay
+		if f.Jitter > 0 {
+			delay += time.Duration(rng.Int63n(int64(f.Jitter)))
+		}
+		drop = rng.Float64() < f.Drop
+		fail = !drop && rng.Float64() < f.Error
+	})
+	return delay, drop, fail
+}
+
+// inject applies the rule's faults to a response, waiting out any delay.
+// It returns ErrDrop for a dropped query, or the context's error if it
+// ends first.
+func (rule *Rule) inject(ctx context.Context, response *dns.Msg) (*dns.Msg, error) {
+	delay, drop, fail := rule.fault()
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	if drop {
+		return nil, ErrDrop
+	}
+	if fail {
+		failed := new(dns.Msg)
+		failed.SetRcode(response, dns.RcodeServerFailure)
+		failed.Id = response.Id
+		return failed, nil
+	}
+	return response, nil
+}
@@ -0,0 +1,355 @@
+package spec
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/miekg/dns"
+)
+
+// index is the compiled form of a list of rules, so that finding
+// the rules for a name costs a lookup per label rather than a scan
+// of every rule, and records are only parsed once.
+type index struct {
+	// exact holds rules by canonical name
+	exact map[string][]*compiledRule
+	// suffix holds "*.example.com." rules by "example.com."
+	suffix map[string][]*compiledRule
+	// other holds wildcards not on a label boundary, like "*example.com."
+	// and "*", which need checking one by one
+	other []*compiledRule
+	// patterns holds glob and regex rules, also checked one by one
+	patterns []*compiledRule
+	// rules is the slice the index was compiled from
+	rules []*Rule
+}
+
+type compiledRule struct {
+	// order is the position of the rule, which decides between matches
+	order   int
+	rule    *Rule
+	records map[uint16][]record
+	// base is the rule's Reply
+	base *compiledReply
+	// types are the query types with their own Reply, over the base
+	types map[uint16]*compiledReply
+	// wildcard is the suffix an "other" rule matches
+	wildcard string
+	// pattern is what a glob or regex rule matches
+	pattern *regexp.Regexp
+	// steps is the rule's sequence, if it has one
+	steps []*compiledStep
+	// clients and subnets are the networks the rule is limited to
+	clients []*net.IPNet
+	subnets []*net.IPNet
+}
+
+// record is either parsed up front or, if it depends on the
+// query, kept as a template to be executed per query
+type record struct {
+	rr       dns.RR
+	template *template.Template
+	line     int
+	rule     string
+	qtype    string
+}
+
+func (r record) build(data *TemplateData) (dns.RR, error) {
+	if r.rr != nil {
+		return dns.Copy(r.rr), nil
+	}
+
+	rr, err := expandRecord(r.template, data)
+	if err != nil {
+		return nil, &RecordError{Rule: r.rule, Qtype: r.qtype, Line: r.line, Err: err}
+	}
+	return rr, nil
+}
+
+// sampleClientIP stands in for the client when checking templates
+const sampleClientIP = "192.0.2.1"
+
+func isTemplate(val string) bool {
+	return strings.Contains(val, "{{")
+}
+
+// compile indexes the rules, returning a *ValidationError
+// listing every rule or record that can't be used
+func compile(rules []*Rule) (*index, error) {
+	idx := &index{
+		exact:  map[string][]*compiledRule{},
+		suffix: map[string][]*compiledRule{},
+		rules:  rules,
+	}
+	errs := []*RecordError{}
+
+	for i, rule := range rules {
+		c, ruleErrs := compileRule(rule)
+		errs = append(errs, ruleErrs...)
+		c.order = i
+		idx.put(c)
+	}
+
+	if len(errs) > 0 {
+		return nil, &ValidationError{Errors: errs}
+	}
+	return idx, nil
+}
+
+// compiledFrom reports whether the index was compiled from rules, so
+// that appending to Rules or replacing it is noticed.  Only the slice
+// is compared, not every rule, to keep lookups cheap.
+func (idx *index) compiledFrom(rules []*Rule) bool {
+	if len(rules) != len(idx.rules) {
+		return false
+	}
+	return len(rules) == 0 || &rules[0] == &idx.rules[0]
+}
+
+// put adds a compiled rule to the index, in place of the
+// one compiled from the same rule if there is one
+func (idx *index) put(c *compiledRule) {
+	rule := c.rule
+	name := normalizeName(rule.Name)
+	switch {
+	case c.pattern != nil:
+		idx.patterns = putRule(idx.patterns, c)
+	case rule.Match != "" && rule.Match != MatchExact:
+		// bad pattern, already reported
+	case !strings.HasPrefix(name, "*"):
+		idx.exact[name] = putRule(idx.exact[name], c)
+	case strings.HasPrefix(name, "*.") && name != "*.":
+		key := name[2:]
+		idx.suffix[key] = putRule(idx.suffix[key], c)
+	default:
+		c.wildcard = name[1:]
+		idx.other = putRule(idx.other, c)
+	}
+}
+
+func putRule(compiled []*compiledRule, c *compiledRule) []*compiledRule {
+	for i, existing := range compiled {
+		if existing.rule == c.rule {
+			compiled[i] = c
+			return compiled
+		}
+	}
+	return append(compiled, c)
+}
+
+// answers is whether the rule answers a query type at all
+func (c *compiledRule) answers(qtype uint16) bool {
+	if _, ok := c.records[qtype]; ok {
+		return true
+	}
+	if _, ok := c.types[qtype]; ok || c.rule.Rcode != "" {
+		return true
+	}
+	for _, step := range c.steps {
+		if _, ok := step.records[qtype]; ok || step.Rcode != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// reply returns how the rule replies to a query type, and its records
+func (c *compiledRule) reply(qtype uint16) (*compiledReply, []record) {
+	reply, ok := c.types[qtype]
+	if !ok {
+		reply = c.base
+	}
+	return reply, c.records[qtype]
+}
+
+// ruleCompiler holds what is needed to compile the parts of a rule
+type ruleCompiler struct {
+	rule *Rule
+	// sample is a query the rule matches to check templates
+	// against, nil if there is no knowing one
+	sample *TemplateData
+	errs   []*RecordError
+}
+
+func (rc *ruleCompiler) fail(qtype string, path string, err error) {
+	rc.errs = append(rc.errs, &RecordError{Rule: rc.rule.Name, Qtype: qtype, Line: rc.rule.lineOf(path), Err: err})
+}
+
+// records compiles a list of record strings found at path
+func (rc *ruleCompiler) records(qtype string, path string, vals []string) []record {
+	compiled := make([]record, 0, len(vals))
+
+	for i, val := range vals {
+		itemPath := fmt.Sprintf("%s/%d", path, i)
+		rec := record{line: rc.rule.lineOf(itemPath), rule: rc.rule.Name, qtype: qtype}
+
+		var err error
+		if isTemplate(val) {
+			rec.template, err = parseTemplate(val)
+			if err == nil && rc.sample != nil {
+				sample := *rc.sample
+				sample.Type = qtype
+				_, err = expandRecord(rec.template, &sample)
+			}
+		} else {
+			rec.rr, err = parseRecord(val)
+		}
+
+		if err != nil {
+			rc.fail(qtype, itemPath, err)
+			continue
+		}
+		compiled = append(compiled, rec)
+	}
+	return compiled
+}
+
+// reply compiles a Reply found at path
+func (rc *ruleCompiler) reply(qtype string, path string, reply Reply) *compiledReply {
+	if reply.Rcode != "" {
+		if _, err := parseRcode(reply.Rcode); err != nil {
+			rc.fail(qtype, path, err)
+		}
+	}
+
+	return &compiledReply{
+		Reply:      reply,
+		authority:  rc.records(qtype, join(path, "authority"), reply.Authority),
+		additional: rc.records(qtype, join(path, "additional"), reply.Additional),
+	}
+}
+
+func join(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "/" + key
+}
+
+func compileRule(rule *Rule) (*compiledRule, []*RecordError) {
+	c := &compiledRule{
+		rule:    rule,
+		records: map[uint16][]record{},
+		types:   map[uint16]*compiledReply{},
+	}
+	rc := &ruleCompiler{rule: rule}
+
+	if rule.Name == "" {
+		rc.fail("", "", fmt.Errorf("missing name"))
+	}
+
+	if rule.Match != "" && rule.Match != MatchExact {
+		pattern, err := compilePattern(rule.Match, rule.Name)
+		if err != nil {
+			rc.fail("", "match", err)
+		}
+		c.pattern = pattern
+	}
+
+	// records with templates are checked against a name the rule matches
+	if sample := sampleName(rule.Match, rule.Name); sample != "" {
+		rc.sample = &TemplateData{
+			Name:     sample,
+			Labels:   dns.SplitDomainName(sample),
+			ClientIP: sampleClientIP,
+		}
+		if c.pattern != nil {
+			rc.sample.Groups = c.pattern.FindStringSubmatch(normalizeName(sample))
+			rc.sample.groupNames = c.pattern.SubexpNames()
+		}
+	}
+
+	c.base = rc.reply("", "", rule.Reply)
+
+	for qtype, reply := range rule.Types {
+		t, ok := dns.StringToType[qtype]
+		if !ok {
+			rc.fail(qtype, join("types", qtype), fmt.Errorf("unknown record type"))
+			continue
+		}
+		c.types[t] = c.base.overlay(rc.reply(qtype, join("types", qtype), Reply{}.overlay(reply)))
+	}
+
+	c.records = rc.recordsByType("records", rule.Records)
+	c.steps = rc.steps()
+	rc.checkOrder()
+	rc.checkFaults()
+	c.clients = rc.networks("clients", rule.Clients)
+	c.subnets = rc.networks("client_subnets", rule.ClientSubnets)
+	return c, rc.errs
+}
+
+// recordsByType compiles records keyed by type name found at path
+func (rc *ruleCompiler) recordsByType(path string, records map[string][]string) map[uint16][]record {
+	compiled := map[uint16][]record{}
+	for qtype, vals := range records {
+		t, ok := dns.StringToType[qtype]
+		if !ok {
+			rc.fail(qtype, join(path, qtype), fmt.Errorf("unknown record type"))
+			continue
+		}
+		compiled[t] = rc.records(qtype, join(path, qtype), vals)
+	}
+	return compiled
+}
+
+// match returns the rules matching a name, in rule order
+func (idx *index) match(domain string) []*compiledRule {
+	domain = normalizeName(domain)
+
+	matches := append([]*compiledRule{}, idx.exact[domain]...)
+
+	// "*.example.com." matches anything under example.com.
+	// so look up each parent of the name
+	for i, start := range dns.Split(domain) {
+		if i > 0 {
+			matches = append(matches, idx.suffix[domain[start:]]...)
+		}
+	}
+
+	for _, c := range idx.other {
+		if strings.HasSuffix(domain, c.wildcard) {
+			matches = append(matches, c)
+		}
+	}
+
+	for _, c := range idx.patterns {
+		if c.pattern.MatchString(domain) {
+			matches = append(matches, c)
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].order < matches[j].order
+	})
+	return matches
+}
+
+func normalizeName(d string) string {
+	return dns.CanonicalName(d)
+}
+
+// parseRecord parses a record string
+func parseRecord(val string) (dns.RR, error) {
+	rr, err := dns.NewRR(val)
+	if err != nil {
+		return nil, err
+	}
+	if rr == nil {
+		return nil, fmt.Errorf("empty record")
+	}
+	return rr, nil
+}
+
+// expandRecord executes a record template and parses the result
+func expandRecord(t *template.Template, data *TemplateData) (dns.RR, error) {
+	val, err := executeTemplate(t, data)
+	if err != nil {
+		return nil, err
+	}
+	return parseRecord(val)
+}
@@ -0,0 +1,64 @@
+package spec
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// How a rule's name is matched against query names.  Whatever the match
+// type, rules are tried in order and the first that matches the name and
+// has records for the query type wins.
+const (
+	// MatchExact matches the name exactly, the default.  A leading "*"
+	// matches any name ending in the rest, e.g. "*.example.com.".
+	MatchExact = "exact"
+	// MatchGlob matches a shell style pattern where "*" is any run of
+	// characters within a label and "?" any one character, e.g.
+	// "api-*.prod.*.example.com.".  Each wildcard is a template group.
+	MatchGlob = "glob"
+	// MatchRegex matches a regular expression against the whole name,
+	// ignoring case, with or without the trailing dot.  Capture groups
+	// are available to templates.
+	MatchRegex = "regex"
+)
+
+// compilePattern turns a glob or regex rule name into a regular expression
+func compilePattern(match string, name string) (*regexp.Regexp, error) {
+	switch match {
+	case MatchGlob:
+		return regexp.Compile("^(?i)" + globToRegex(dns.Fqdn(name)) + "$")
+	case MatchRegex:
+		return regexp.Compile(`^(?i:` + name + `)\.?$`)
+	}
+	return nil, fmt.Errorf("unknown match type %q, expected %s, %s or %s", match, MatchExact, MatchGlob, MatchRegex)
+}
+
+func globToRegex(glob string) string {
+	b := &strings.Builder{}
+	for _, c := range glob {
+		switch c {
+		case '*':
+			b.WriteString(`([^.]*)`)
+		case '?':
+			b.WriteString(`([^.])`)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// sampleName makes up a query name a rule matches, to check its templates
+// against, or returns "" if there's no telling what a regex might match.
+func sampleName(match string, name string) string {
+	switch match {
+	case MatchRegex:
+		return ""
+	case MatchGlob:
+		name = strings.ReplaceAll(name, "?", "x")
+	}
+	return dns.Fqdn(strings.ReplaceAll(name, "*", "wildcard"))
+}
@@ -0,0 +1,195 @@
+package spec
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// OrderFixed returns answers in file order
+	OrderFixed = "fixed"
+	// OrderRoundRobin rotates the answers by one on each query
+	OrderRoundRobin = "round_robin"
+	// OrderShuffle returns answers in random order
+	OrderShuffle = "shuffle"
+	// OrderWeighted picks answers at random by their Weights, so
+	// that with a Limit heavier records are returned more often
+	OrderWeighted = "weighted"
+)
+
+// checkOrder checks the rule's order settings
+func (rc *ruleCompiler) checkOrder() {
+	rule := rc.rule
+	switch rule.Order {
+	case "", OrderFixed, OrderRoundRobin, OrderShuffle, OrderWeighted:
+	default:
+		rc.fail("", "order", fmt.Errorf("unknown order %q", rule.Order))
+	}
+
+	if rule.Limit < 0 {
+		rc.fail("", "limit", fmt.Errorf("negative limit %d", rule.Limit))
+	}
+
+	for i, w := range rule.Weights {
+		if w < 0 {
+			rc.fail("", fmt.Sprintf("weights/%d", i), fmt.Errorf("negative weight %d", w))
+		}
+	}
+	if len(rule.Weights) > 0 && rule.Order != OrderWeighted {
+		rc.fail("", "weights", fmt.Errorf("weights need order %q", OrderWeighted))
+	}
+}
+
+// arrange returns the indexes of the n answers to use, in order,
+// or nil to use them all as they are
+func (rule *Rule) arrange(n int) []int {
+	if (rule.Order == "" || rule.Order == OrderFixed) && (rule.Limit == 0 || rule.Limit >= n) {
+		return nil
+	}
+
+	indexes := make([]int, n)
+	for i := range indexes {
+		indexes[i] = i
+	}
+
+	switch rule.Order {
+	case OrderRoundRobin:
+		if n > 0 {
+			start := int(rule.rotation.Add(1)-1) % n
+			indexes = append(indexes[start:], indexes[:start]...)
+		}
+	case OrderShuffle:
+		rule.random(func(rng *rand.Rand) {
+			rng.Shuffle(n, func(i, j int) {
+				indexes[i], indexes[j] = indexes[j], indexes[i]
+			})
+		})
+	case OrderWeighted:
+		rule.random(func(rng *rand.Rand) {
+			indexes = rule.weighted(rng, indexes)
+		})
+	}
+
+	if rule.Limit > 0 && rule.Limit < len(indexes) {
+		indexes = indexes[:rule.Limit]
+	}
+	return indexes
+}
+
+// arrangeAnswers orders and limits the answers of the query type,
+// leaving others, such as the CNAMEs leading to them, where they are
+func (rule *Rule) arrangeAnswers(qtype uint16, answers []dns.RR) []dns.RR {
+	slots := []int{}
+	for i, rr := range answers {
+		if rr.Header().Rrtype == qtype {
+			slots = append(slots, i)
+		}
+	}
+	indexes := rule.arrange(len(slots))
+	if indexes == nil {
+		return answers
+	}
+
+	// the arranged answers fill the first of the slots, in order,
+	// and the slots of any left out by the limit are dropped
+	arranged := make([]dns.RR, 0, len(answers))
+	next := 0
+	for _, rr := range answers {
+		if rr.Header().Rrtype != qtype {
+			arranged = append(arranged, rr)
+			continue
+		}
+		if next < len(indexes) {
+			arranged = append(arranged, answers[slots[indexes[next]]])
+			next++
+		}
+	}
+	return arranged
+}
+
+// weight is the weight of the i'th answer, one if not given
+func (rule *Rule) weight(i int) int {
+	if i < len(rule.Weights) {
+		return rule.Weights[i]
+	}
+	return 1
+}
+
+// weighted orders indexes by drawing them one at a time, each
+// with a chance in proportion to its weight.  Answers with a
+// weight of zero are never returned.
+func (rule *Rule) weighted(rng *rand.Rand, indexes []int) []int {
+	remaining := []int{}
+	total := 0
+	for _, i := range indexes {
+		if w := rule.weight(i); w > 0 {
+			remaining = append(remaining, i)
+			total += w
+		}
+	}
+
+	picked := []int{}
+	for len(remaining) > 0 {
+		n := rng.Intn(total)
+		for j, i := range remaining {
+			if n -= rule.weight(i); n < 0 {
+				picked = append(picked, i)
+				total -= rule.weight(i)
+				remaining = append(remaining[:j], remaining[j+1:]...)
+				break
+			}
+		}
+	}
+	return picked
+}
+
+// random calls f with the rule's random source, seeding
+// it from Seed, or the clock, on first use
+func (rule *Rule) random(f func(rng *rand.Rand)) {
+	rule.rngMu.Lock()
+	defer rule.rngMu.Unlock()
+
+	if rule.rng == nil {
+		seed := time.Now().UnixNano()
+		if rule.Seed != nil {
+			seed = *rule.Seed
+		}
+		rule.rng = rand.New(rand.NewSource(seed))
+	}
+	f(rule.rng)
+}
+
+// resetOrder starts round robin rotation over and reseeds the random source
+func (rule *Rule) resetOrder() {
+	rule.rotation.Store(0)
+
+	rule.rngMu.Lock()
+	defer rule.rngMu.Unlock()
+	rule.rng = nil
+}
+
+// Arrange orders the answers of a response from elsewhere, such as
+// one being recorded, by the order settings of the rule for the query.
+// The response is left as is if no rule has order settings for it.
+func (r *Responses) Arrange(query *dns.Msg, response *dns.Msg) error {
+	if query == nil || len(query.Question) == 0 {
+		return ErrNoQuestion
+	}
+	question := query.Question[0]
+	matches, err := r.match(question.Name)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range matches {
+		if !c.answers(question.Qtype) {
+			continue
+		}
+		response.Answer = c.rule.arrangeAnswers(question.Qtype, response.Answer)
+		return nil
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package spec
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Reply sets the header of the responses built from a rule
+type Reply struct {
+	// Rcode is the response code, e.g. NOERROR, NXDOMAIN, SERVFAIL or
+	// REFUSED.  Setting it makes the rule answer every query type, with
+	// no records for types it has none for.
+	Rcode string `yaml:"rcode,omitempty"`
+	// Authoritative sets the AA bit
+	Authoritative *bool `yaml:"authoritative,omitempty"`
+	// RecursionAvailable sets the RA bit
+	RecursionAvailable *bool `yaml:"recursion_available,omitempty"`
+	// Truncated sets the TC bit on responses so that clients
+	// retry the query over TCP.
+	Truncated *bool `yaml:"truncated,omitempty"`
+	// Authority records go in the authority section, e.g. an SOA
+	// for a negative answer or NS records for a delegation
+	Authority []string `yaml:"authority,omitempty"`
+	// Additional records go in the additional section, e.g.
+	// glue A and AAAA records for SRV or MX targets
+	Additional []string `yaml:"additional,omitempty"`
+}
+
+// compiledReply is a Reply with its records parsed
+type compiledReply struct {
+	Reply
+	authority  []record
+	additional []record
+}
+
+// overlay returns the reply with any fields set in o replacing its own
+func (r Reply) overlay(o *Reply) Reply {
+	if o == nil {
+		return r
+	}
+	if o.Rcode != "" {
+		r.Rcode = o.Rcode
+	}
+	if o.Authoritative != nil {
+		r.Authoritative = o.Authoritative
+	}
+	if o.RecursionAvailable != nil {
+		r.RecursionAvailable = o.RecursionAvailable
+	}
+	if o.Truncated != nil {
+		r.Truncated = o.Truncated
+	}
+	if o.Authority != nil {
+		r.Authority = o.Authority
+	}
+	if o.Additional != nil {
+		r.Additional = o.Additional
+	}
+	return r
+}
+
+// overlay returns the compiled reply with any fields set in o replacing its own
+func (r *compiledReply) overlay(o *compiledReply) *compiledReply {
+	c := *r
+	c.Reply = r.Reply.overlay(&o.Reply)
+	if o.Authority != nil {
+		c.authority = o.authority
+	}
+	if o.Additional != nil {
+		c.additional = o.additional
+	}
+	return &c
+}
+
+func parseRcode(rcode string) (int, error) {
+	code, ok := dns.StringToRcode[strings.ToUpper(rcode)]
+	if !ok {
+		return 0, fmt.Errorf("unknown rcode %q", rcode)
+	}
+	return code, nil
+}
+
+// apply sets the header fields of a response
+func (r Reply) apply(response *dns.Msg) {
+	if r.Rcode != "" {
+		// checked when compiled
+		response.Rcode, _ = parseRcode(r.Rcode)
+	}
+	if r.Authoritative != nil {
+		response.Authoritative = *r.Authoritative
+	}
+	if r.RecursionAvailable != nil {
+		response.RecursionAvailable = *r.RecursionAvailable
+	}
+	if r.Truncated != nil {
+		response.Truncated = *r.Truncated
+	}
+}
+
+// NegativeTTL is the TTL of the SOA in negative answers, and so
+// how long clients cache them.
+const NegativeTTL = 60
+
+// NegativeSOA makes up an SOA record to put in the authority
+// section of negative answers about name.
+func NegativeSOA(name string) dns.RR {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    NegativeTTL,
+		},
+		Ns:      "ns.dnsmock.",
+		Mbox:    "hostmaster.dnsmock.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  NegativeTTL,
+	}
+}
@@ -0,0 +1,106 @@
+package spec
+
+import (
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The methods here change the rules of a spec that is in use, safely
+// for concurrent lookups.  The rules are checked first, and left as
+// they were if there is a problem with them.
+
+// update swaps in the rules made by f from the current ones,
+// if they compile
+func (r *Responses) update(f func(rules []*Rule) []*Rule) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rules := f(append([]*Rule{}, r.Rules...))
+	idx, err := compile(rules)
+	if err != nil {
+		return err
+	}
+	r.Rules = rules
+	r.index = idx
+	return nil
+}
+
+// AddRule adds a rule after the others
+func (r *Responses) AddRule(rule *Rule) error {
+	return r.update(func(rules []*Rule) []*Rule {
+		return append(rules, rule)
+	})
+}
+
+// ReplaceRule replaces the rules with the given name by rule, in
+// place of the first of them, or adds it if there were none.
+func (r *Responses) ReplaceRule(name string, rule *Rule) error {
+	return r.update(func(rules []*Rule) []*Rule {
+		replaced := []*Rule{}
+		added := false
+		for _, existing := range rules {
+			if !sameName(existing.Name, name) {
+				replaced = append(replaced, existing)
+			} else if !added {
+				replaced = append(replaced, rule)
+				added = true
+			}
+		}
+		if !added {
+			replaced = append(replaced, rule)
+		}
+		return replaced
+	})
+}
+
+// RemoveRule removes the rules with the given name,
+// returning how many there were
+func (r *Responses) RemoveRule(name string) (int, error) {
+	removed := 0
+	err := r.update(func(rules []*Rule) []*Rule {
+		kept := []*Rule{}
+		for _, existing := range rules {
+			if sameName(existing.Name, name) {
+				removed++
+				continue
+			}
+			kept = append(kept, existing)
+		}
+		return kept
+	})
+	return removed, err
+}
+
+// SetRules replaces all the rules
+func (r *Responses) SetRules(rules []*Rule) error {
+	return r.update(func([]*Rule) []*Rule {
+		return rules
+	})
+}
+
+// RulesYAML returns the rules with the given name as a YAML list,
+// or all of them if name is empty, along with how many there are.
+func (r *Responses) RulesYAML(name string) (string, int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	rules := []*Rule{}
+	for _, rule := range r.Rules {
+		if name == "" || sameName(rule.Name, name) {
+			rules = append(rules, rule)
+		}
+	}
+
+	raw, err := yaml.Marshal(rules)
+	if err != nil {
+		return "", 0, err
+	}
+	return string(raw), len(rules), nil
+}
+
+// sameName is whether two rule names are the same, ignoring
+// case and a trailing dot
+func sameName(a string, b string) bool {
+	return strings.EqualFold(strings.TrimSuffix(a, "."), strings.TrimSuffix(b, "."))
+}
@@ -0,0 +1,120 @@
+package spec
+
+import "fmt"
+
+const (
+	// SequenceStick keeps replying with the last step of a sequence
+	SequenceStick = "stick"
+	// SequenceLoop starts a sequence over after its last step
+	SequenceLoop = "loop"
+)
+
+// Step is one reply in a rule's sequence.  Its records replace the
+// rule's for the types it has records for, and its Reply settings
+// override the rule's.
+type Step struct {
+	Records map[string][]string `yaml:"records,omitempty"`
+	Reply   `yaml:",inline"`
+	// Repeat is how many queries in a row get this step, one if not set
+	Repeat int `yaml:"repeat,omitempty"`
+}
+
+type compiledStep struct {
+	*compiledReply
+	records map[uint16][]record
+	repeat  uint64
+}
+
+// reply returns how the step replies to a query type, given the
+// reply and records the rule would use without it
+func (s *compiledStep) reply(qtype uint16, reply *compiledReply, records []record) (*compiledReply, []record) {
+	if stepRecords, ok := s.records[qtype]; ok {
+		records = stepRecords
+	}
+	return reply.overlay(s.compiledReply), records
+}
+
+// steps compiles the rule's sequence, checking its settings
+func (rc *ruleCompiler) steps() []*compiledStep {
+	rule := rc.rule
+	switch rule.SequenceEnd {
+	case "", SequenceStick, SequenceLoop:
+	default:
+		rc.fail("", "sequence_end", fmt.Errorf("unknown sequence_end %q, want %q or %q",
+			rule.SequenceEnd, SequenceStick, SequenceLoop))
+	}
+
+	steps := []*compiledStep{}
+	for i, step := range rule.Sequence {
+		path := fmt.Sprintf("sequence/%d", i)
+		if step == nil {
+			step = &Step{}
+		}
+		if step.Repeat < 0 {
+			rc.fail("", join(path, "repeat"), fmt.Errorf("negative repeat %d", step.Repeat))
+		}
+
+		c := &compiledStep{
+			compiledReply: rc.reply("", path, step.Reply),
+			records:       rc.recordsByType(join(path, "records"), step.Records),
+			repeat:        1,
+		}
+		if step.Repeat > 1 {
+			c.repeat = uint64(step.Repeat)
+		}
+		steps = append(steps, c)
+	}
+	return steps
+}
+
+// next counts a query of a type against the rule, returning the
+// step of its sequence to reply with, nil if it has none.  Each
+// type has its own count, so that e.g. the A and AAAA lookups a
+// client makes together both see the first step.
+func (c *compiledRule) next(qtype uint16) *compiledStep {
+	if len(c.steps) == 0 {
+		return nil
+	}
+
+	n := c.rule.count(qtype)
+
+	total := uint64(0)
+	for _, step := range c.steps {
+		total += step.repeat
+	}
+	if n >= total {
+		if c.rule.SequenceEnd != SequenceLoop {
+			return c.steps[len(c.steps)-1]
+		}
+		n %= total
+	}
+
+	for _, step := range c.steps {
+		if n < step.repeat {
+			return step
+		}
+		n -= step.repeat
+	}
+	return nil
+}
+
+// count counts a query of a type for the rule's sequence,
+// returning how many there were before it
+func (rule *Rule) count(qtype uint16) uint64 {
+	rule.queriesMu.Lock()
+	defer rule.queriesMu.Unlock()
+
+	if rule.queries == nil {
+		rule.queries = map[uint16]uint64{}
+	}
+	n := rule.queries[qtype]
+	rule.queries[qtype] = n + 1
+	return n
+}
+
+// resetSequence starts the rule's sequence over for every type
+func (rule *Rule) resetSequence() {
+	rule.queriesMu.Lock()
+	defer rule.queriesMu.Unlock()
+	rule.queries = nil
+}
@@ -1,54 +1,272 @@
 package spec
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/miekg/dns"
 	"gopkg.in/yaml.v3"
 )
 
 type Responses struct {
+	// Rules in the order they are matched.  Appending to or replacing
+	// the slice is noticed on the next lookup, but after changing a rule
+	// or an element in place, call Compile so that lookups see the
+	// change.  Use AddRule and the like while the spec is in use.
 	Rules []*Rule `yaml:"rules"`
+
+	mu sync.RWMutex
+	// index is compiled from the rules, nil or compiled
+	// from another slice when they have changed
+	index *index
+
+	expectMu     sync.Mutex
+	expectations []*Expectation
 }
 type Rule struct {
-	Name    string              `yaml:"name"`
+	Name string `yaml:"name"`
+	// Match is how Name is matched: MatchExact (the default), MatchGlob or MatchRegex
+	Match   string              `yaml:"match,omitempty"`
 	Records map[string][]string `yaml:"records"`
+	// Reply sets the rcode and flags of the rule's responses
+	Reply `yaml:",inline"`
+	// Types overrides Reply for particular query types, by type name
+	Types map[string]*Reply `yaml:"types,omitempty"`
+	// Sequence gives the rule different replies for successive queries
+	Sequence []*Step `yaml:"sequence,omitempty"`
+	// SequenceEnd is what happens once the sequence is used up,
+	// SequenceStick (the default) or SequenceLoop
+	SequenceEnd string `yaml:"sequence_end,omitempty"`
+
+	// Order is how answers are ordered: OrderFixed (the default),
+	// OrderRoundRobin, OrderShuffle or OrderWeighted
+	Order string `yaml:"order,omitempty"`
+	// Seed makes OrderShuffle and OrderWeighted repeatable
+	Seed *int64 `yaml:"seed,omitempty"`
+	// Weights are the weights of the answers of the query type, in order, for
+	// OrderWeighted.  Answers without one have a weight of 1.
+	Weights []int `yaml:"weights,omitempty"`
+	// Limit is the most answers to return, zero for all of them
+	Limit int `yaml:"limit,omitempty"`
+	// Faults delay, drop or fail the rule's replies
+	Faults `yaml:",inline"`
+	// Clients limits the rule to clients with these addresses,
+	// given as CIDRs or single IPs
+	Clients []string `yaml:"clients,omitempty"`
+	// ClientSubnets limits the rule to queries with an EDNS Client
+	// Subnet option within these CIDRs
+	ClientSubnets []string `yaml:"client_subnets,omitempty"`
+	// Optional rules are not reported by Verify if never used
+	Optional bool `yaml:"optional,omitempty"`
+
+	// hits counts the queries the rule has matched
+	hits atomic.Uint64
+	// queries counts the queries the rule's sequence has
+	// answered, per query type
+	queriesMu sync.Mutex
+	queries   map[uint16]uint64
+	// rotation counts round robin queries
+	rotation atomic.Uint64
+	rngMu    sync.Mutex
+	rng      *rand.Rand
+
+	// where the rule and its parts were in the YAML, for errors
+	line  int
+	lines map[string]int
+}
+
+// UnmarshalYAML decodes a rule, keeping track of line numbers
+func (rule *Rule) UnmarshalYAML(node *yaml.Node) error {
+	type plain Rule
+	if err := node.Decode((*plain)(rule)); err != nil {
+		return err
+	}
+
+	rule.line = node.Line
+	rule.lines = map[string]int{}
+	trackLines(node, "", rule.lines)
+	return nil
+}
+
+// trackLines records the line of every key and list item under node by
+// its path, e.g. "records/A" for a key and "records/A/0" for an item.
+func trackLines(node *yaml.Node, path string, lines map[string]int) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			p := node.Content[i].Value
+			if path != "" {
+				p = path + "/" + p
+			}
+			lines[p] = node.Content[i].Line
+			trackLines(node.Content[i+1], p, lines)
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			p := fmt.Sprintf("%s/%d", path, i)
+			lines[p] = item.Line
+			trackLines(item, p, lines)
+		}
+	}
+}
+
+// lineOf is the line of the part of the rule at path,
+// falling back to the line of the rule
+func (rule *Rule) lineOf(path string) int {
+	if line, ok := rule.lines[path]; ok {
+		return line
+	}
+	return rule.line
+}
+
+// RecordError describes a problem with a rule in a spec
+type RecordError struct {
+	Rule  string
+	Qtype string
+	// Line is the line of the record, or of the rule, in the YAML. Zero if not known.
+	Line int
+	Err  error
+}
+
+func (e *RecordError) Error() string {
+	where := fmt.Sprintf("rule %q", e.Rule)
+	if e.Qtype != "" {
+		where += " " + e.Qtype
+	}
+	if e.Line > 0 {
+		where += fmt.Sprintf(" (line %d)", e.Line)
+	}
+	return fmt.Sprintf("%s: %v", where, e.Err)
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationError lists every problem found in a spec
+type ValidationError struct {
+	Errors []*RecordError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := []string{}
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("invalid spec: %s", strings.Join(msgs, "; "))
 }
 
 func New() *Responses {
 	return &Responses{}
 }
 
-func FromFile(path string) *Responses {
+// FromFile loads and validates a spec from a YAML file
+func FromFile(path string) (*Responses, error) {
 
 	content, err := os.ReadFile(path)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	r, err := FromYAML(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
 	}
-	return FromYAML(string(content))
+	return r, nil
 }
 
-func FromYAML(y string) *Responses {
+// FromYAML parses and validates a spec
+func FromYAML(y string) (*Responses, error) {
 	r := &Responses{}
 
 	err := yaml.Unmarshal([]byte(y), &r)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return r
+
+	if err := r.Compile(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Parse is FromYAML
+func Parse(val string) (*Responses, error) {
+	return FromYAML(val)
+}
+
+// Validate checks that every rule has a name and that every
+// record parses, returning a *ValidationError if not.
+func (r *Responses) Validate() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	_, err := compile(r.Rules)
+	return err
 }
 
-func Parse(val string) Responses {
-	r := Responses{}
-	err := yaml.Unmarshal([]byte(val), &r)
+// Compile validates the rules and indexes them for lookups, parsing
+// every record that does not depend on the query.  It is done on load,
+// and only needs calling again after changing rules in place.
+func (r *Responses) Compile() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	idx, err := compile(r.Rules)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	return r
+	r.index = idx
+	return nil
 }
 
+// indexed reports whether the index is up to date with the rules
+func (r *Responses) indexed() bool {
+	return r.index != nil && r.index.compiledFrom(r.Rules)
+}
+
+// match returns the compiled rules matching a name, in rule
+// order, compiling the rules first if they changed
+func (r *Responses) match(name string) ([]*compiledRule, error) {
+	r.mu.RLock()
+	if r.indexed() {
+		defer r.mu.RUnlock()
+		return r.index.match(name), nil
+	}
+	r.mu.RUnlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.indexed() {
+		idx, err := compile(r.Rules)
+		if err != nil {
+			return nil, err
+		}
+		r.index = idx
+	}
+	return r.index.match(name), nil
+}
+
+// Add records a response as the rule for its name and type, replacing
+// what was there.  Negative answers keep their rcode and SOA, under Types.
+// A query without a question, or no response, is ignored.
 func (r *Responses) Add(query *dns.Msg, response *dns.Msg) {
+	if query == nil || len(query.Question) == 0 || response == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// if Rules was changed directly, leave it to the next lookup
+	// to compile them all
+	indexed := r.indexed()
 
 	question := query.Question[0]
 	domain := question.Name
@@ -56,118 +274,237 @@ func (r *Responses) Add(query *dns.Msg, response *dns.Msg) {
 	qtype := dns.TypeToString[question.Qtype]
 
 	var rule *Rule
+	order := 0
 
-	for _, r := range r.Rules {
+	for i, r := range r.Rules {
 		if r.Name == domain {
-			rule = r
+			rule, order = r, i
 			break
 		}
 	}
 
 	if rule == nil {
-		rule = &Rule{
-			Name:    domain,
-			Records: map[string][]string{},
-		}
+		rule, order = &Rule{Name: domain}, len(r.Rules)
 		r.Rules = append(r.Rules, rule)
 	}
 
-	val := []string{}
-
-	for _, a := range response.Answer {
-		val = append(val, a.String())
+	// a negative answer has no records, just an rcode and an SOA
+	negative := len(response.Answer) == 0
+	if negative {
+		delete(rule.Records, qtype)
+	} else {
+		if rule.Records == nil {
+			rule.Records = map[string][]string{}
+		}
+		val := []string{}
+		for _, a := range response.Answer {
+			val = append(val, a.String())
+		}
+		rule.Records[qtype] = val
 	}
 
-	rule.Records[qtype] = val
+	// keep the rcode and the other sections per type, as they go
+	// with the answer
+	rcode := ""
+	if negative || response.Rcode != dns.RcodeSuccess {
+		rcode = dns.RcodeToString[response.Rcode]
+	}
+	authority := recordStrings(response.Ns)
+	additional := recordStrings(response.Extra)
+	reply := rule.Types[qtype]
+	if reply == nil && (rcode != "" || authority != nil || additional != nil) {
+		if rule.Types == nil {
+			rule.Types = map[string]*Reply{}
+		}
+		reply = &Reply{}
+		rule.Types[qtype] = reply
+	}
+	if reply != nil {
+		reply.Rcode = rcode
+		reply.Authority = authority
+		reply.Additional = additional
+	}
+	if !indexed {
+		r.index = nil
+		return
+	}
+	r.reindex(rule, order)
 }
 
-func (r Responses) Count() int {
-	return len(r.Rules)
+// reindex compiles a rule that changed into the index, rather than
+// compiling every rule again, which would make recording slow
+func (r *Responses) reindex(rule *Rule, order int) {
+	c, errs := compileRule(rule)
+	if len(errs) > 0 {
+		// leave it to the next lookup to report
+		r.index = nil
+		return
+	}
+	c.order = order
+	r.index.put(c)
+	r.index.rules = r.Rules
 }
 
-func normalizeName(d string) string {
-	return dns.CanonicalName(d)
+// recordStrings formats records for a rule, leaving out
+// OPT pseudo-records, nil if there are none
+func recordStrings(rrs []dns.RR) []string {
+	var vals []string
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		vals = append(vals, rr.String())
+	}
+	return vals
 }
 
-func (r Responses) FindDomains(domain string) []*Rule {
-
-	domain = normalizeName(domain)
-
-	rules := []*Rule{}
-
+// Reset clears the state of every rule, starting sequences
+// and round robin rotation over, and zeroes hit counts and
+// the counts of expectations
+func (r *Responses) Reset() {
+	r.mu.RLock()
 	for _, rule := range r.Rules {
-		k := normalizeName(rule.Name)
+		rule.hits.Store(0)
+		rule.resetSequence()
+		rule.resetOrder()
+	}
+	r.mu.RUnlock()
 
-		if k == domain {
-			rules = append(rules, rule)
-			continue
-		}
+	r.expectMu.Lock()
+	defer r.expectMu.Unlock()
+	for _, e := range r.expectations {
+		e.count.Store(0)
+	}
+}
 
-		if strings.HasPrefix(k, "*") {
-			d := k[1:]
+func (r *Responses) Count() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.Rules)
+}
 
-			if strings.HasSuffix(domain, d) {
-				rules = append(rules, rule)
-				continue
-			}
-		}
+// FindDomains returns the rules whose name matches domain, in order
+func (r *Responses) FindDomains(domain string) []*Rule {
+	matches, err := r.match(domain)
+	if err != nil {
+		return nil
 	}
 
+	rules := []*Rule{}
+	for _, c := range matches {
+		rules = append(rules, c.rule)
+	}
 	return rules
 }
 
-func (r Responses) expand(query dns.Question, val string) string {
-	expanded := val
+// ErrNoQuestion is returned for a query without a question to answer
+var ErrNoQuestion = errors.New("query has no question")
 
-	// TODO: replace with text.template if any more complicated than this
-	if strings.Contains(val, "{{Name}}") {
-		expanded = strings.ReplaceAll(val, "{{Name}}", query.Name)
-	}
-
-	return expanded
+// Query is a DNS question along with what is known about who asked it
+type Query struct {
+	Msg *dns.Msg
+	// ClientIP is the address of the client, nil if not known
+	ClientIP net.IP
+	// ClientSubnet is from the EDNS Client Subnet option, nil if not sent
+	ClientSubnet *net.IPNet
 }
 
-func (r Responses) Find(query *dns.Msg) *dns.Msg {
-	question := query.Question[0]
-	domain := question.Name
+// Find returns the response for a query, or nil if no rule matches.
+// An error means a matching record could not be built, or is ErrDrop
+// if the rule dropped the query.
+func (r *Responses) Find(query *dns.Msg) (*dns.Msg, error) {
+	return r.Lookup(Query{Msg: query})
+}
 
-	qtype := dns.TypeToString[question.Qtype]
+// Lookup is Find with details about the client, which
+// record templates can use.
+func (r *Responses) Lookup(q Query) (*dns.Msg, error) {
+	return r.LookupContext(context.Background(), q)
+}
 
-	d := r.FindDomains(domain)
-	if len(d) == 0 {
-		return nil
+// LookupContext is Lookup, waiting out any delay from the matching
+// rule's faults unless ctx ends first.  A dropped query returns ErrDrop,
+// and one without a question ErrNoQuestion.
+func (r *Responses) LookupContext(ctx context.Context, q Query) (*dns.Msg, error) {
+	query := q.Msg
+	if query == nil || len(query.Question) == 0 {
+		return nil, ErrNoQuestion
 	}
+	question := query.Question[0]
+	matches, err := r.match(question.Name)
+	if err != nil {
+		return nil, err
+	}
+	r.expected(question)
+	var data *TemplateData
 
-	for _, rule := range r.FindDomains(domain) {
-		val := rule.Records[qtype]
-		if val != nil {
-			response := &dns.Msg{}
-			response.SetReply(query)
-
-			for _, v := range val {
+	for _, c := range matches {
+		if !c.answers(question.Qtype) || !c.sees(q) {
+			continue
+		}
+		c.rule.hits.Add(1)
+		reply, records := c.reply(question.Qtype)
+		if step := c.next(question.Qtype); step != nil {
+			reply, records = step.reply(question.Qtype, reply, records)
+		}
 
-				v2 := r.expand(question, v)
+		response := &dns.Msg{}
+		response.SetReply(query)
+		reply.apply(response)
 
-				rr, err := dns.NewRR(v2)
-				if err != nil {
-					panic(err)
-				}
-				response.Answer = append(response.Answer, rr)
+		if data == nil {
+			data = newTemplateData(q)
+			if c.pattern != nil {
+				data.Groups = c.pattern.FindStringSubmatch(normalizeName(question.Name))
+				data.groupNames = c.pattern.SubexpNames()
 			}
+		}
+
+		var err error
+		if response.Answer, err = buildRecords(records, data); err != nil {
+			return nil, err
+		}
+		response.Answer = c.rule.arrangeAnswers(question.Qtype, response.Answer)
+		if response.Ns, err = buildRecords(reply.authority, data); err != nil {
+			return nil, err
+		}
+		if response.Extra, err = buildRecords(reply.additional, data); err != nil {
+			return nil, err
+		}
 
-			return response
+		// negative answers need an SOA for clients to cache them by
+		if len(response.Answer) == 0 && len(response.Ns) == 0 &&
+			(response.Rcode == dns.RcodeSuccess || response.Rcode == dns.RcodeNameError) {
+			response.Ns = append(response.Ns, NegativeSOA(question.Name))
 		}
+
+		return c.rule.inject(ctx, response)
 	}
 
-	return nil
+	return nil, nil
+}
 
+// buildRecords builds the records for a query, nil if there are none
+func buildRecords(records []record, data *TemplateData) ([]dns.RR, error) {
+	var rrs []dns.RR
+	for _, record := range records {
+		rr, err := record.build(data)
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
 }
 
-func (r Responses) YAML() string {
+func (r *Responses) YAML() (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
 	raw, err := yaml.Marshal(r)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
-	return string(raw)
+	return string(raw), nil
 }
@@ -1,25 +1,22 @@
 package spec
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
 )
 
-func findHelper(content string, question dns.Question) []dns.RR {
-	r := FromYAML(content)
-
-	msg := &dns.Msg{
-		Question: []dns.Question{
-			question,
-		},
-	}
-	res := r.Find(msg)
-	if res == nil {
-		return nil
-	}
-	return res.Answer
+func findHelper(t *testing.T, content string, question dns.Question) []dns.RR {
+	r, err := FromYAML(content)
+	require.NoError(t, err)
+	return findHelperSpec(t, r, question)
 }
 
 var content = `
@@ -41,7 +38,7 @@ rules:
 
 func TestFromFile(t *testing.T) {
 
-	answer := findHelper(content, dns.Question{
+	answer := findHelper(t, content, dns.Question{
 		Name:   "internet.com.",
 		Qtype:  dns.TypeA,
 		Qclass: dns.ClassINET,
@@ -55,7 +52,7 @@ func TestFromFile(t *testing.T) {
 
 func TestWildcard(t *testing.T) {
 
-	answer := findHelper(content, dns.Question{
+	answer := findHelper(t, content, dns.Question{
 		Name:   "test.awstest.com.",
 		Qtype:  dns.TypeA,
 		Qclass: dns.ClassINET,
@@ -69,7 +66,7 @@ func TestWildcard(t *testing.T) {
 
 func TestGlob(t *testing.T) {
 
-	answer := findHelper(content, dns.Question{
+	answer := findHelper(t, content, dns.Question{
 		Name:   "tacos.com.",
 		Qtype:  dns.TypeSRV,
 		Qclass: dns.ClassINET,
@@ -80,3 +77,1208 @@ func TestGlob(t *testing.T) {
 	require.Equal(t, "tacos.com.\t60\tIN\tSRV\t0 100 42 tacos.com.", srv.String())
 
 }
+
+func TestInvalidSpec(t *testing.T) {
+	_, err := FromYAML(`
+rules:
+  - name: "good.com."
+    records:
+      A:
+        - "good.com. 300 IN A 1.2.3.4"
+  - name: "bad.com."
+    records:
+      A:
+        - "bad.com. 300 IN A 1.2.3.4"
+        - "bad.com. 300 IN A 1.2.3"
+      BOGUS:
+        - "bad.com. 300 IN A 1.2.3.4"
+  - records:
+      A:
+        - "{{Name}} 300 IN A 1.2.3.4"
+`)
+	require.Error(t, err)
+
+	verr, ok := err.(*ValidationError)
+	require.True(t, ok)
+	require.Len(t, verr.Errors, 3)
+
+	errs := map[string]*RecordError{}
+	for _, e := range verr.Errors {
+		errs[e.Rule+"/"+e.Qtype] = e
+	}
+	require.Equal(t, 11, errs["bad.com./A"].Line)
+	require.Equal(t, 12, errs["bad.com./BOGUS"].Line)
+	require.Equal(t, 14, errs["/"].Line)
+	require.Contains(t, err.Error(), `rule "bad.com." A (line 11)`)
+
+	_, err = FromYAML("rules: [")
+	require.Error(t, err)
+
+	_, err = FromFile("/does/not/exist.yaml")
+	require.Error(t, err)
+}
+
+func TestFindBadExpansion(t *testing.T) {
+	r, err := FromYAML(content)
+	require.NoError(t, err)
+
+	msg := &dns.Msg{
+		Question: []dns.Question{
+			{Name: "bad name.", Qtype: dns.TypeSRV, Qclass: dns.ClassINET},
+		},
+	}
+
+	require.NotPanics(t, func() {
+		res, err := r.Find(msg)
+		require.Nil(t, res)
+		require.Error(t, err)
+	})
+}
+
+func TestMatchOrder(t *testing.T) {
+	r, err := FromYAML(`
+rules:
+  - name: "*.b.example.com."
+    records:
+      A: ["{{Name}} 300 IN A 1.1.1.1"]
+  - name: "a.b.example.com."
+    records:
+      A: ["a.b.example.com. 300 IN A 2.2.2.2"]
+      TXT: ["a.b.example.com. 300 IN TXT exact"]
+  - name: "*example.com."
+    records:
+      AAAA: ["{{Name}} 300 IN AAAA ::1"]
+  - name: "*.example.com."
+    records:
+      A: ["{{Name}} 300 IN A 3.3.3.3"]
+`)
+	require.NoError(t, err)
+
+	names := func(domain string) []string {
+		out := []string{}
+		for _, rule := range r.FindDomains(domain) {
+			out = append(out, rule.Name)
+		}
+		return out
+	}
+
+	require.Equal(t, []string{"*.b.example.com.", "a.b.example.com.", "*example.com.", "*.example.com."}, names("A.B.Example.COM"))
+	require.Equal(t, []string{"*example.com.", "*.example.com."}, names("b.example.com."))
+	require.Equal(t, []string{"*example.com."}, names("example.com."))
+	require.Equal(t, []string{"*example.com."}, names("notexample.com."))
+	require.Empty(t, names("."))
+
+	// first rule with the qtype wins
+	answer := findHelper(t, `
+rules:
+  - name: "*.b.example.com."
+    records:
+      A: ["{{Name}} 300 IN A 1.1.1.1"]
+  - name: "a.b.example.com."
+    records:
+      TXT: ["a.b.example.com. 300 IN TXT exact"]
+`, dns.Question{Name: "a.b.example.com.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET})
+	require.Len(t, answer, 1)
+	require.Equal(t, []string{"exact"}, answer[0].(*dns.TXT).Txt)
+}
+
+func TestNoQuestion(t *testing.T) {
+	r, err := FromYAML(`
+rules:
+  - name: "api.test."
+    records:
+      A: ["api.test. 60 IN A 10.0.0.1"]
+`)
+	require.NoError(t, err)
+
+	_, err = r.Find(&dns.Msg{})
+	require.ErrorIs(t, err, ErrNoQuestion)
+	_, err = r.Find(nil)
+	require.ErrorIs(t, err, ErrNoQuestion)
+	require.ErrorIs(t, r.Arrange(&dns.Msg{}, &dns.Msg{}), ErrNoQuestion)
+
+	r.Add(&dns.Msg{}, &dns.Msg{})
+	require.Len(t, r.Rules, 1)
+}
+
+func TestAddRecompiles(t *testing.T) {
+	r := New()
+
+	q := new(dns.Msg)
+	q.SetQuestion("new.com.", dns.TypeA)
+
+	res, err := r.Find(q)
+	require.NoError(t, err)
+	require.Nil(t, res)
+
+	a, err := dns.NewRR("new.com. 300 IN A 1.2.3.4")
+	require.NoError(t, err)
+	r.Add(q, &dns.Msg{Answer: []dns.RR{a}})
+
+	res, err = r.Find(q)
+	require.NoError(t, err)
+	require.Len(t, res.Answer, 1)
+
+	// answers are copies, so changing them leaves the spec alone
+	res.Answer[0].Header().Ttl = 1
+	res, err = r.Find(q)
+	require.NoError(t, err)
+	require.Equal(t, uint32(300), res.Answer[0].Header().Ttl)
+
+	// another type goes in the same rule, which still answers both
+	q6 := new(dns.Msg)
+	q6.SetQuestion("new.com.", dns.TypeAAAA)
+	r.Add(q6, &dns.Msg{Answer: []dns.RR{mustRR(t, "new.com. 300 IN AAAA ::1")}})
+	require.Len(t, r.Rules, 1)
+	res, err = r.Find(q6)
+	require.NoError(t, err)
+	require.Len(t, res.Answer, 1)
+	res, err = r.Find(q)
+	require.NoError(t, err)
+	require.Len(t, res.Answer, 1)
+}
+
+func TestRulesChangedDirectly(t *testing.T) {
+	r := New()
+
+	find := func(name string) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		res, err := r.Find(q)
+		require.NoError(t, err)
+		return res
+	}
+	require.Nil(t, find("direct.com."))
+
+	// appending after a lookup is seen by the next one
+	r.Rules = append(r.Rules, &Rule{
+		Name:    "direct.com.",
+		Records: map[string][]string{"A": {"direct.com. 300 IN A 1.2.3.4"}},
+	})
+	require.NotNil(t, find("direct.com."))
+
+	// including when Add has grown the slice in between
+	q := new(dns.Msg)
+	q.SetQuestion("added.com.", dns.TypeA)
+	r.Add(q, &dns.Msg{Answer: []dns.RR{mustRR(t, "added.com. 300 IN A 1.2.3.5")}})
+	r.Rules = append(r.Rules, &Rule{
+		Name:    "later.com.",
+		Records: map[string][]string{"A": {"later.com. 300 IN A 1.2.3.6"}},
+	})
+	r.Add(q, &dns.Msg{Answer: []dns.RR{mustRR(t, "added.com. 300 IN A 1.2.3.7")}})
+	require.NotNil(t, find("later.com."))
+	require.Equal(t, "1.2.3.7", find("added.com.").Answer[0].(*dns.A).A.String())
+
+	// and replacing the slice
+	r.Rules = []*Rule{r.Rules[0]}
+	require.NotNil(t, find("direct.com."))
+	require.Nil(t, find("later.com."))
+}
+
+// BenchmarkRecord records answers for many names, looking each up
+// first as the recorder does by way of the replay resolver
+func BenchmarkRecord(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		r := New()
+		for n := 0; n < 4000; n++ {
+			q := new(dns.Msg)
+			q.SetQuestion(fmt.Sprintf("host-%d.example.", n), dns.TypeA)
+			if _, err := r.Find(q); err != nil {
+				b.Fatal(err)
+			}
+			a, err := dns.NewRR(fmt.Sprintf("host-%d.example. 60 IN A 10.0.%d.%d", n, n/256, n%256))
+			if err != nil {
+				b.Fatal(err)
+			}
+			r.Add(q, &dns.Msg{Answer: []dns.RR{a}})
+		}
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	r, err := FromYAML(`
+rules:
+  - name: "*.pods.test."
+    records:
+      A:
+        - "{{.Name}} 60 IN A {{haship \"10.1.0.0/16\" .Name}}"
+      TXT:
+        - "{{.Name}} 60 IN TXT \"{{label 0}}\" \"{{label -2 | upper}}\" \"{{.Type}}\" \"{{lower .Name}}\""
+      PTR:
+        - "{{reverse .ClientIP}} 60 IN PTR {{Name}}"
+`)
+	require.NoError(t, err)
+
+	lookup := func(name string, qtype uint16, client string) []dns.RR {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		res, err := r.Lookup(Query{Msg: msg, ClientIP: net.ParseIP(client)})
+		require.NoError(t, err)
+		require.NotNil(t, res)
+		return res.Answer
+	}
+
+	a1 := lookup("web-1.pods.test.", dns.TypeA, "")
+	a1again := lookup("web-1.pods.test.", dns.TypeA, "")
+	a2 := lookup("web-2.pods.test.", dns.TypeA, "")
+
+	ip1 := a1[0].(*dns.A).A
+	require.Equal(t, ip1.String(), a1again[0].(*dns.A).A.String())
+	require.NotEqual(t, ip1.String(), a2[0].(*dns.A).A.String())
+	_, network, _ := net.ParseCIDR("10.1.0.0/16")
+	require.True(t, network.Contains(ip1))
+
+	txt := lookup("Web-1.pods.test.", dns.TypeTXT, "")
+	require.Equal(t, []string{"Web-1", "PODS", "TXT", "web-1.pods.test."}, txt[0].(*dns.TXT).Txt)
+
+	ptr := lookup("web-1.pods.test.", dns.TypePTR, "10.2.3.4")
+	require.Equal(t, "4.3.2.10.in-addr.arpa.", ptr[0].Header().Name)
+	require.Equal(t, "web-1.pods.test.", ptr[0].(*dns.PTR).Ptr)
+}
+
+func TestTemplateErrors(t *testing.T) {
+	_, err := FromYAML(`
+rules:
+  - name: "*.pods.test."
+    records:
+      A:
+        - "{{.Name} 60 IN A 1.2.3.4"
+        - "{{.Name}} 60 IN A {{haship \"nope\" .Name}}"
+        - "{{.Nope}} 60 IN A 1.2.3.4"
+`)
+	require.Error(t, err)
+	require.Len(t, err.(*ValidationError).Errors, 3)
+}
+
+func TestHashIP(t *testing.T) {
+	ip, err := hashIP("fd00::/64", "a.test.")
+	require.NoError(t, err)
+	_, network, _ := net.ParseCIDR("fd00::/64")
+	require.True(t, network.Contains(net.ParseIP(ip)))
+
+	ip, err = hashIP("10.0.0.7/32", "a.test.")
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.7", ip)
+}
+
+func TestPatternMatching(t *testing.T) {
+	r, err := FromYAML(`
+rules:
+  - name: "api-*.prod.*.example."
+    match: glob
+    records:
+      TXT:
+        - "{{.Name}} 60 IN TXT \"{{group 1}}\" \"{{group 2}}\""
+  - name: 'svc-(?P<env>[a-z]+)-(?P<shard>\d+)\.example\.'
+    match: regex
+    records:
+      A:
+        - "{{.Name}} 60 IN A 10.0.{{group \"shard\"}}.1"
+      TXT:
+        - "{{.Name}} 60 IN TXT \"{{group \"env\"}}\""
+  - name: "svc-*.example."
+    match: glob
+    records:
+      A:
+        - "{{.Name}} 60 IN A 10.9.9.9"
+      AAAA:
+        - "{{.Name}} 60 IN AAAA ::1"
+  - name: "exact.example."
+    match: exact
+    records:
+      A:
+        - "exact.example. 60 IN A 1.1.1.1"
+`)
+	require.NoError(t, err)
+
+	find := func(name string, qtype uint16) []dns.RR {
+		return findHelperSpec(t, r, dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET})
+	}
+
+	txt := find("API-users.prod.eu1.example.", dns.TypeTXT)
+	require.Len(t, txt, 1)
+	require.Equal(t, []string{"users", "eu1"}, txt[0].(*dns.TXT).Txt)
+
+	// globs don't cross labels
+	require.Nil(t, find("api-users.x.prod.eu1.example.", dns.TypeTXT))
+
+	a := find("svc-staging-42.example.", dns.TypeA)
+	require.Equal(t, "10.0.42.1", a[0].(*dns.A).A.String())
+	txt = find("svc-staging-42.example.", dns.TypeTXT)
+	require.Equal(t, []string{"staging"}, txt[0].(*dns.TXT).Txt)
+
+	// the regex rule comes first, but has no AAAA so the glob answers
+	aaaa := find("svc-staging-42.example.", dns.TypeAAAA)
+	require.Len(t, aaaa, 1)
+
+	// and regexes match the whole name
+	a = find("svc-staging-42.example.com.", dns.TypeA)
+	require.Nil(t, a)
+
+	a = find("exact.example.", dns.TypeA)
+	require.Equal(t, "1.1.1.1", a[0].(*dns.A).A.String())
+}
+
+func TestPatternErrors(t *testing.T) {
+	_, err := FromYAML(`
+rules:
+  - name: "svc-(.example."
+    match: regex
+    records:
+      A: ["1.example. 60 IN A 1.1.1.1"]
+  - name: "svc.example."
+    match: fuzzy
+    records:
+      A: ["1.example. 60 IN A 1.1.1.1"]
+  - name: "svc-*.example."
+    match: glob
+    records:
+      A: ["{{.Name}} 60 IN A 10.0.0.{{group 2}}"]
+`)
+	require.Error(t, err)
+	require.Len(t, err.(*ValidationError).Errors, 3)
+}
+
+func findHelperSpec(t *testing.T, r *Responses, question dns.Question) []dns.RR {
+	res, err := r.Find(&dns.Msg{Question: []dns.Question{question}})
+	require.NoError(t, err)
+	if res == nil {
+		return nil
+	}
+	return res.Answer
+}
+
+func TestRcodesAndFlags(t *testing.T) {
+	r, err := FromYAML(`
+rules:
+  - name: "gone.example."
+    rcode: NXDOMAIN
+  - name: "broken.example."
+    rcode: servfail
+  - name: "v4only.example."
+    authoritative: true
+    records:
+      A: ["v4only.example. 60 IN A 1.2.3.4"]
+    types:
+      AAAA:
+      MX:
+        rcode: REFUSED
+        recursion_available: true
+      A:
+        truncated: true
+  - name: "v4only.example."
+    records:
+      TXT: ["v4only.example. 60 IN TXT second"]
+`)
+	require.NoError(t, err)
+
+	find := func(name string, qtype uint16) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		res, err := r.Find(msg)
+		require.NoError(t, err)
+		return res
+	}
+
+	res := find("gone.example.", dns.TypeA)
+	require.Equal(t, dns.RcodeNameError, res.Rcode)
+	require.Empty(t, res.Answer)
+	require.Len(t, res.Ns, 1)
+	require.IsType(t, &dns.SOA{}, res.Ns[0])
+
+	res = find("broken.example.", dns.TypeTXT)
+	require.Equal(t, dns.RcodeServerFailure, res.Rcode)
+	require.Empty(t, res.Ns)
+
+	res = find("v4only.example.", dns.TypeA)
+	require.Equal(t, dns.RcodeSuccess, res.Rcode)
+	require.Len(t, res.Answer, 1)
+	require.True(t, res.Authoritative)
+	require.True(t, res.Truncated)
+	require.Empty(t, res.Ns)
+
+	// NODATA
+	res = find("v4only.example.", dns.TypeAAAA)
+	require.Equal(t, dns.RcodeSuccess, res.Rcode)
+	require.True(t, res.Authoritative)
+	require.False(t, res.Truncated)
+	require.Empty(t, res.Answer)
+	require.Len(t, res.Ns, 1)
+
+	res = find("v4only.example.", dns.TypeMX)
+	require.Equal(t, dns.RcodeRefused, res.Rcode)
+	require.True(t, res.RecursionAvailable)
+
+	// types without records or a reply fall through to later rules
+	res = find("v4only.example.", dns.TypeTXT)
+	require.Len(t, res.Answer, 1)
+	require.False(t, res.Authoritative)
+
+	require.Nil(t, find("v4only.example.", dns.TypeSRV))
+
+	_, err = FromYAML(`
+rules:
+  - name: "a.example."
+    rcode: NOPE
+  - name: "b.example."
+    types:
+      BOGUS:
+      A:
+        rcode: NOPE
+`)
+	require.Error(t, err)
+	require.Len(t, err.(*ValidationError).Errors, 3)
+}
+
+func TestAuthorityAndAdditional(t *testing.T) {
+	r, err := FromYAML(`
+rules:
+  - name: "_api._tcp.example."
+    records:
+      SRV:
+        - "_api._tcp.example. 60 IN SRV 10 5 8080 api-1.example."
+    additional:
+      - "api-1.example. 60 IN A 10.0.0.1"
+      - "api-1.example. 60 IN AAAA fd00::1"
+  - name: "*.sub.example."
+    rcode: NOERROR
+    authority:
+      - "sub.example. 300 IN NS ns1.sub.example."
+    additional:
+      - "ns1.sub.example. 300 IN A 10.0.0.53"
+  - name: "gone.example."
+    rcode: NXDOMAIN
+    authority:
+      - "example. 30 IN SOA ns.example. admin.example. 7 3600 600 86400 30"
+  - name: "mx.example."
+    records:
+      MX: ["mx.example. 60 IN MX 10 {{label 0}}-in.example."]
+    types:
+      MX:
+        additional: ["{{label 0}}-in.example. 60 IN A 10.0.0.25"]
+`)
+	require.NoError(t, err)
+
+	find := func(name string, qtype uint16) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		res, err := r.Find(msg)
+		require.NoError(t, err)
+		require.NotNil(t, res)
+		return res
+	}
+
+	res := find("_api._tcp.example.", dns.TypeSRV)
+	require.Len(t, res.Answer, 1)
+	require.Empty(t, res.Ns)
+	require.Len(t, res.Extra, 2)
+	require.Equal(t, "10.0.0.1", res.Extra[0].(*dns.A).A.String())
+
+	res = find("db.sub.example.", dns.TypeA)
+	require.Empty(t, res.Answer)
+	require.Len(t, res.Ns, 1)
+	require.Equal(t, "ns1.sub.example.", res.Ns[0].(*dns.NS).Ns)
+	require.Len(t, res.Extra, 1)
+
+	// a given SOA replaces the default one
+	res = find("gone.example.", dns.TypeA)
+	require.Equal(t, dns.RcodeNameError, res.Rcode)
+	require.Len(t, res.Ns, 1)
+	require.Equal(t, uint32(7), res.Ns[0].(*dns.SOA).Serial)
+
+	res = find("mx.example.", dns.TypeMX)
+	require.Len(t, res.Extra, 1)
+	require.Equal(t, "mx-in.example.", res.Extra[0].Header().Name)
+
+	_, err = FromYAML(`
+rules:
+  - name: "bad.example."
+    records:
+      A: ["bad.example. 60 IN A 10.0.0.1"]
+    types:
+      A:
+        additional:
+          - "bad.example. 60 IN A 10.0.0.1"
+          - "bad.example. IN A nope"
+`)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `rule "bad.example." A (line 10)`)
+}
+
+func TestAddSections(t *testing.T) {
+	r := New()
+
+	query := new(dns.Msg)
+	query.SetQuestion("_api._tcp.example.", dns.TypeSRV)
+	response := new(dns.Msg)
+	response.SetReply(query)
+	response.Answer = []dns.RR{mustRR(t, "_api._tcp.example. 60 IN SRV 10 5 8080 api-1.example.")}
+	response.Extra = []dns.RR{mustRR(t, "api-1.example. 60 IN A 10.0.0.1")}
+	response.SetEdns0(1232, false)
+
+	r.Add(query, response)
+	res, err := r.Find(query)
+	require.NoError(t, err)
+	require.Len(t, res.Answer, 1)
+	require.Len(t, res.Extra, 1)
+	require.Equal(t, "10.0.0.1", res.Extra[0].(*dns.A).A.String())
+
+	// recording again without the section drops it
+	response.Extra = nil
+	r.Add(query, response)
+	res, err = r.Find(query)
+	require.NoError(t, err)
+	require.Empty(t, res.Extra)
+}
+
+func mustRR(t *testing.T, val string) dns.RR {
+	rr, err := dns.NewRR(val)
+	require.NoError(t, err)
+	return rr
+}
+
+func TestSequence(t *testing.T) {
+	r, err := FromYAML(`
+rules:
+  - name: "flaky.example."
+    records:
+      A: ["flaky.example. 60 IN A 10.0.0.1"]
+    sequence:
+      - rcode: SERVFAIL
+        repeat: 2
+      - {}
+  - name: "rotate.example."
+    sequence_end: loop
+    sequence:
+      - records:
+          A: ["rotate.example. 60 IN A 10.0.0.1"]
+      - records:
+          A: ["rotate.example. 60 IN A 10.0.0.2"]
+        authoritative: true
+`)
+	require.NoError(t, err)
+
+	find := func(name string) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		res, err := r.Find(msg)
+		require.NoError(t, err)
+		require.NotNil(t, res)
+		return res
+	}
+
+	rcodes := []int{}
+	for i := 0; i < 4; i++ {
+		rcodes = append(rcodes, find("flaky.example.").Rcode)
+	}
+	require.Equal(t, []int{dns.RcodeServerFailure, dns.RcodeServerFailure, dns.RcodeSuccess, dns.RcodeSuccess}, rcodes)
+	res := find("flaky.example.")
+	require.Len(t, res.Answer, 1)
+
+	answers := []string{}
+	for i := 0; i < 3; i++ {
+		res := find("rotate.example.")
+		require.Equal(t, i == 1, res.Authoritative)
+		answers = append(answers, res.Answer[0].(*dns.A).A.String())
+	}
+	require.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.1"}, answers)
+
+	// state survives recompiling, until reset
+	require.NoError(t, r.Compile())
+	require.Equal(t, dns.RcodeSuccess, find("flaky.example.").Rcode)
+	r.Reset()
+	require.Equal(t, dns.RcodeServerFailure, find("flaky.example.").Rcode)
+	require.Equal(t, "10.0.0.1", find("rotate.example.").Answer[0].(*dns.A).A.String())
+
+	_, err = FromYAML(`
+rules:
+  - name: "bad.example."
+    sequence_end: forever
+    sequence:
+      - repeat: -1
+      - records:
+          BOGUS: ["x"]
+`)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `rule "bad.example." (line 4): unknown sequence_end`)
+	require.Contains(t, err.Error(), `(line 6): negative repeat`)
+	require.Contains(t, err.Error(), `rule "bad.example." BOGUS (line 8): unknown record type`)
+}
+
+func TestSequencePerType(t *testing.T) {
+	r, err := FromYAML(`
+rules:
+  - name: "dual.example."
+    records:
+      A: ["dual.example. 60 IN A 10.0.0.1"]
+      AAAA: ["dual.example. 60 IN AAAA ::1"]
+    sequence:
+      - rcode: SERVFAIL
+      - {}
+`)
+	require.NoError(t, err)
+
+	find := func(qtype uint16) int {
+		msg := new(dns.Msg)
+		msg.SetQuestion("dual.example.", qtype)
+		res, err := r.Find(msg)
+		require.NoError(t, err)
+		return res.Rcode
+	}
+
+	// a client asks for both types at once, and each fails first
+	require.Equal(t, dns.RcodeServerFailure, find(dns.TypeAAAA))
+	require.Equal(t, dns.RcodeServerFailure, find(dns.TypeA))
+	require.Equal(t, dns.RcodeSuccess, find(dns.TypeAAAA))
+	require.Equal(t, dns.RcodeSuccess, find(dns.TypeA))
+
+	r.Reset()
+	require.Equal(t, dns.RcodeServerFailure, find(dns.TypeA))
+	require.Equal(t, dns.RcodeServerFailure, find(dns.TypeAAAA))
+}
+
+func TestSequenceConcurrent(t *testing.T) {
+	r, err := FromYAML(`
+rules:
+  - name: "seq.example."
+    sequence:
+      - records:
+          A: ["seq.example. 60 IN A 10.0.0.1"]
+        repeat: 50
+      - records:
+          A: ["seq.example. 60 IN A 10.0.0.2"]
+`)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	counts := map[string]int{}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msg := new(dns.Msg)
+			msg.SetQuestion("seq.example.", dns.TypeA)
+			res, err := r.Find(msg)
+			require.NoError(t, err)
+			mu.Lock()
+			counts[res.Answer[0].(*dns.A).A.String()]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, map[string]int{"10.0.0.1": 50, "10.0.0.2": 50}, counts)
+}
+
+func TestOrder(t *testing.T) {
+	r, err := FromYAML(`
+rules:
+  - name: "fixed.example."
+    limit: 2
+    records:
+      A: ["fixed.example. 60 IN A 10.0.0.1", "fixed.example. 60 IN A 10.0.0.2", "fixed.example. 60 IN A 10.0.0.3"]
+  - name: "rr.example."
+    order: round_robin
+    records:
+      A: ["rr.example. 60 IN A 10.0.0.1", "rr.example. 60 IN A 10.0.0.2", "rr.example. 60 IN A 10.0.0.3"]
+  - name: "shuffle.example."
+    order: shuffle
+    seed: 42
+    records:
+      A: ["shuffle.example. 60 IN A 10.0.0.1", "shuffle.example. 60 IN A 10.0.0.2", "shuffle.example. 60 IN A 10.0.0.3"]
+  - name: "weighted.example."
+    order: weighted
+    seed: 7
+    limit: 1
+    weights: [9, 1, 0]
+    records:
+      A: ["weighted.example. 60 IN A 10.0.0.1", "weighted.example. 60 IN A 10.0.0.2", "weighted.example. 60 IN A 10.0.0.3"]
+`)
+	require.NoError(t, err)
+
+	find := func(name string) []string {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		res, err := r.Find(msg)
+		require.NoError(t, err)
+		ips := []string{}
+		for _, rr := range res.Answer {
+			ips = append(ips, rr.(*dns.A).A.String())
+		}
+		return ips
+	}
+
+	require.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, find("fixed.example."))
+
+	require.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, find("rr.example."))
+	require.Equal(t, []string{"10.0.0.2", "10.0.0.3", "10.0.0.1"}, find("rr.example."))
+	require.Equal(t, []string{"10.0.0.3", "10.0.0.1", "10.0.0.2"}, find("rr.example."))
+	require.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, find("rr.example."))
+
+	// a seed makes shuffles repeat after a reset
+	shuffles := [][]string{}
+	for i := 0; i < 5; i++ {
+		ips := find("shuffle.example.")
+		require.ElementsMatch(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, ips)
+		shuffles = append(shuffles, ips)
+	}
+	r.Reset()
+	for i := 0; i < 5; i++ {
+		require.Equal(t, shuffles[i], find("shuffle.example."))
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		ips := find("weighted.example.")
+		require.Len(t, ips, 1)
+		counts[ips[0]]++
+	}
+	require.Zero(t, counts["10.0.0.3"])
+	require.Greater(t, counts["10.0.0.1"], 800)
+	require.Greater(t, counts["10.0.0.2"], 50)
+
+	_, err = FromYAML(`
+rules:
+  - name: "bad.example."
+    order: sorted
+    limit: -1
+    weights: [1]
+`)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `(line 4): unknown order "sorted"`)
+	require.Contains(t, err.Error(), `(line 5): negative limit -1`)
+	require.Contains(t, err.Error(), `(line 6): weights need order "weighted"`)
+}
+
+func TestOrderCNAME(t *testing.T) {
+	r, err := FromYAML(`
+rules:
+  - name: "www.example."
+    order: round_robin
+    records:
+      A:
+        - "www.example. 60 IN CNAME lb.example."
+        - "lb.example. 60 IN A 10.0.0.1"
+        - "lb.example. 60 IN A 10.0.0.2"
+  - name: "one.example."
+    order: round_robin
+    limit: 1
+    records:
+      A:
+        - "one.example. 60 IN CNAME lb.example."
+        - "lb.example. 60 IN A 10.0.0.1"
+        - "lb.example. 60 IN A 10.0.0.2"
+`)
+	require.NoError(t, err)
+
+	answers := func(rrs []dns.RR) []string {
+		all := []string{}
+		for _, rr := range rrs {
+			switch rr := rr.(type) {
+			case *dns.CNAME:
+				all = append(all, rr.Target)
+			case *dns.A:
+				all = append(all, rr.A.String())
+			}
+		}
+		return all
+	}
+	find := func(name string) []string {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		res, err := r.Find(msg)
+		require.NoError(t, err)
+		return answers(res.Answer)
+	}
+
+	// the CNAME stays first, and only the addresses rotate
+	require.Equal(t, []string{"lb.example.", "10.0.0.1", "10.0.0.2"}, find("www.example."))
+	require.Equal(t, []string{"lb.example.", "10.0.0.2", "10.0.0.1"}, find("www.example."))
+	require.Equal(t, []string{"lb.example.", "10.0.0.1", "10.0.0.2"}, find("www.example."))
+
+	// and the limit is on the addresses, not the CNAME
+	require.Equal(t, []string{"lb.example.", "10.0.0.1"}, find("one.example."))
+	require.Equal(t, []string{"lb.example.", "10.0.0.2"}, find("one.example."))
+
+	// responses from elsewhere are arranged the same way
+	r.Reset()
+	query := new(dns.Msg)
+	query.SetQuestion("one.example.", dns.TypeA)
+	response := new(dns.Msg)
+	response.SetReply(query)
+	response.Answer = []dns.RR{
+		mustRR(t, "one.example. 60 IN CNAME lb.example."),
+		mustRR(t, "lb.example. 60 IN A 10.0.0.3"),
+		mustRR(t, "lb.example. 60 IN A 10.0.0.4"),
+	}
+	require.NoError(t, r.Arrange(query, response))
+	require.Equal(t, []string{"lb.example.", "10.0.0.3"}, answers(response.Answer))
+	response.Answer = append(response.Answer, mustRR(t, "lb.example. 60 IN A 10.0.0.4"))
+	require.NoError(t, r.Arrange(query, response))
+	require.Equal(t, []string{"lb.example.", "10.0.0.4"}, answers(response.Answer))
+}
+
+func TestFaults(t *testing.T) {
+	r, err := FromYAML(`
+rules:
+  - name: "slow.example."
+    delay: 100ms
+    jitter: 50ms
+    records:
+      A: ["slow.example. 60 IN A 10.0.0.1"]
+  - name: "lost.example."
+    drop: 1
+    records:
+      A: ["lost.example. 60 IN A 10.0.0.1"]
+  - name: "failing.example."
+    error: 1.0
+    records:
+      A: ["failing.example. 60 IN A 10.0.0.1"]
+  - name: "sometimes.example."
+    error: 0.5
+    seed: 1
+    records:
+      A: ["sometimes.example. 60 IN A 10.0.0.1"]
+`)
+	require.NoError(t, err)
+
+	query := func(name string) Query {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		return Query{Msg: msg}
+	}
+
+	start := time.Now()
+	res, err := r.LookupContext(context.Background(), query("slow.example."))
+	require.NoError(t, err)
+	require.Len(t, res.Answer, 1)
+	require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = r.LookupContext(ctx, query("slow.example."))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	_, err = r.Lookup(query("lost.example."))
+	require.ErrorIs(t, err, ErrDrop)
+
+	q := query("failing.example.")
+	res, err = r.Lookup(q)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeServerFailure, res.Rcode)
+	require.Equal(t, q.Msg.Id, res.Id)
+	require.Empty(t, res.Answer)
+
+	failures := 0
+	for i := 0; i < 100; i++ {
+		res, err := r.Lookup(query("sometimes.example."))
+		require.NoError(t, err)
+		if res.Rcode == dns.RcodeServerFailure {
+			failures++
+		}
+	}
+	require.Greater(t, failures, 25)
+	require.Less(t, failures, 75)
+
+	_, err = FromYAML(`
+rules:
+  - name: "bad.example."
+    delay: -1s
+    drop: 2
+    error: -0.5
+`)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `(line 4): negative delay -1s`)
+	require.Contains(t, err.Error(), `(line 5): drop 2 is not between 0 and 1`)
+	require.Contains(t, err.Error(), `(line 6): error -0.5 is not between 0 and 1`)
+}
+
+func TestViews(t *testing.T) {
+	r, err := FromYAML(`
+rules:
+  - name: "split.example."
+    clients: ["10.0.0.0/8", "fd00::/8", "192.0.2.7"]
+    records:
+      A: ["split.example. 60 IN A 10.1.1.1"]
+  - name: "split.example."
+    client_subnets: ["203.0.113.0/24"]
+    records:
+      A: ["split.example. 60 IN A 203.0.113.1"]
+  - name: "split.example."
+    records:
+      A: ["split.example. 60 IN A 1.1.1.1"]
+`)
+	require.NoError(t, err)
+
+	find := func(clientIP string, subnet string) string {
+		msg := new(dns.Msg)
+		msg.SetQuestion("split.example.", dns.TypeA)
+		q := Query{Msg: msg, ClientIP: net.ParseIP(clientIP)}
+		if subnet != "" {
+			_, q.ClientSubnet, _ = net.ParseCIDR(subnet)
+		}
+		res, err := r.Lookup(q)
+		require.NoError(t, err)
+		return res.Answer[0].(*dns.A).A.String()
+	}
+
+	require.Equal(t, "10.1.1.1", find("10.9.8.7", ""))
+	require.Equal(t, "10.1.1.1", find("fd00::1", ""))
+	require.Equal(t, "10.1.1.1", find("192.0.2.7", ""))
+	require.Equal(t, "1.1.1.1", find("192.0.2.8", ""))
+	require.Equal(t, "203.0.113.1", find("192.0.2.8", "203.0.113.0/25"))
+	// a subnet wider than the rule's isn't within it
+	require.Equal(t, "1.1.1.1", find("192.0.2.8", "203.0.112.0/23"))
+
+	_, err = FromYAML(`
+rules:
+  - name: "bad.example."
+    clients:
+      - "10.0.0.0/33"
+    client_subnets: ["nope"]
+`)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `(line 5): invalid CIDR "10.0.0.0/33"`)
+	require.Contains(t, err.Error(), `(line 6): invalid CIDR "nope"`)
+}
+
+const testZone = `$ORIGIN example.com.
+$TTL 300
+@       IN SOA ns1 hostmaster 2024010101 3600 600 86400 60
+@       IN NS  ns1
+ns1     IN A   10.0.0.53
+www  60 IN A   10.0.0.1
+www     IN A   10.0.0.2
+api     IN CNAME www
+*.apps  IN A   10.0.1.1
+`
+
+func TestFromZone(t *testing.T) {
+	r, err := FromZone(strings.NewReader(testZone), "", "test.zone")
+	require.NoError(t, err)
+
+	names := []string{}
+	for _, rule := range r.Rules {
+		names = append(names, rule.Name)
+	}
+	require.Equal(t, []string{"example.com.", "ns1.example.com.", "www.example.com.", "api.example.com.", "*.apps.example.com."}, names)
+	require.Len(t, r.Rules[2].Records["A"], 2)
+
+	answers := findHelperSpec(t, r, dns.Question{Name: "foo.apps.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	require.Len(t, answers, 1)
+	require.Equal(t, uint32(300), answers[0].Header().Ttl)
+
+	// relative names need an origin from somewhere
+	r, err = FromZone(strings.NewReader("www IN A 10.0.0.1\n"), "example.org", "")
+	require.NoError(t, err)
+	require.Equal(t, "www.example.org.", r.Rules[0].Name)
+
+	_, err = FromZone(strings.NewReader("$ORIGIN example.com.\nwww IN A 10.0.0\n"), "", "bad.zone")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "bad.zone")
+	require.Contains(t, err.Error(), "line: 2")
+}
+
+func TestWriteZone(t *testing.T) {
+	r, err := FromZone(strings.NewReader(testZone), "", "test.zone")
+	require.NoError(t, err)
+	r.Rules = append(r.Rules,
+		&Rule{Name: "web-*.example.com.", Match: MatchGlob},
+		&Rule{Name: "t.example.com.", Records: map[string][]string{"A": {"{{.Name}} 60 IN A 10.0.0.9"}}},
+		&Rule{Name: "other.example.net.", Records: map[string][]string{"TXT": {"other.example.net.\t300\tIN\tTXT\t\"hi\""}}},
+	)
+
+	var b strings.Builder
+	require.NoError(t, r.WriteZone(&b, ""))
+	zone := b.String()
+
+	require.True(t, strings.HasPrefix(zone, "$ORIGIN example.com.\n$TTL 300\n@\tIN\tSOA\t"), zone)
+	require.Contains(t, zone, "www\t60\tIN\tA\t10.0.0.1\n")
+	require.Contains(t, zone, "www\tIN\tA\t10.0.0.2\n")
+	require.Contains(t, zone, "*.apps\tIN\tA\t10.0.1.1\n")
+	require.Contains(t, zone, "other.example.net.\tIN\tTXT\t\"hi\"\n")
+	require.Contains(t, zone, "; skipped glob rule \"web-*.example.com.\"\n")
+	require.Contains(t, zone, "; skipped template")
+
+	// and it reads back the same
+	back, err := FromZone(strings.NewReader(zone), "", "")
+	require.NoError(t, err)
+	require.Len(t, back.Rules, 6)
+	for i, rule := range back.Rules[:5] {
+		require.Equal(t, r.Rules[i].Records, rule.Records, rule.Name)
+	}
+	require.Equal(t, r.Rules[7].Records, back.Rules[5].Records)
+}
+
+func TestWriteZoneSections(t *testing.T) {
+	r := New()
+	soa := mustRR(t, "example.com. 300 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 300")
+	for _, name := range []string{"missing.example.com.", "gone.example.com."} {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		r.Add(q, &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}, Ns: []dns.RR{soa}})
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("_api._tcp.example.com.", dns.TypeSRV)
+	r.Add(q, &dns.Msg{
+		Answer: []dns.RR{mustRR(t, "_api._tcp.example.com. 300 IN SRV 10 5 8080 api.example.com.")},
+		Extra:  []dns.RR{mustRR(t, "api.example.com. 300 IN A 10.0.0.1")},
+	})
+	r.Rules = append(r.Rules, &Rule{
+		Name:  "t.example.com.",
+		Reply: Reply{Additional: []string{"{{.Name}} 60 IN A 10.0.0.9"}},
+	})
+
+	var b strings.Builder
+	require.NoError(t, r.WriteZone(&b, ""))
+	require.Equal(t, `$ORIGIN example.com.
+$TTL 300
+@	IN	SOA	ns.example.com. admin.example.com. 1 3600 600 86400 300
+_api._tcp	IN	SRV	10 5 8080 api.example.com.
+api	IN	A	10.0.0.1
+; skipped template "{{.Name}} 60 IN A 10.0.0.9"
+`, b.String())
+}
+
+func TestRuleMutators(t *testing.T) {
+	r, err := FromYAML(`
+rules:
+  - name: "a.example."
+    records:
+      A: ["a.example. 60 IN A 10.0.0.1"]
+  - name: "b.example."
+    records:
+      A: ["b.example. 60 IN A 10.0.0.2"]
+`)
+	require.NoError(t, err)
+
+	names := func() []string {
+		names := []string{}
+		for _, rule := range r.Rules {
+			names = append(names, rule.Name)
+		}
+		return names
+	}
+
+	// lookups carry on while the rules change
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		msg := new(dns.Msg)
+		msg.SetQuestion("a.example.", dns.TypeA)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				r.Find(msg)
+			}
+		}
+	}()
+
+	require.NoError(t, r.AddRule(&Rule{Name: "c.example.", Records: map[string][]string{"A": {"c.example. 60 IN A 10.0.0.3"}}}))
+	require.Equal(t, []string{"a.example.", "b.example.", "c.example."}, names())
+
+	require.NoError(t, r.ReplaceRule("A.EXAMPLE", &Rule{Name: "a.example.", Reply: Reply{Rcode: "NXDOMAIN"}}))
+	require.Equal(t, []string{"a.example.", "b.example.", "c.example."}, names())
+	require.Equal(t, "NXDOMAIN", r.Rules[0].Rcode)
+
+	require.NoError(t, r.ReplaceRule("d.example.", &Rule{Name: "d.example.", Reply: Reply{Rcode: "REFUSED"}}))
+	require.Equal(t, []string{"a.example.", "b.example.", "c.example.", "d.example."}, names())
+
+	err = r.AddRule(&Rule{Name: "bad.example.", Records: map[string][]string{"A": {"nope"}}})
+	require.Error(t, err)
+	require.Len(t, r.Rules, 4)
+
+	removed, err := r.RemoveRule("b.example.")
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+	require.Equal(t, []string{"a.example.", "c.example.", "d.example."}, names())
+
+	y, count, err := r.RulesYAML("c.example.")
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+	require.Contains(t, y, "10.0.0.3")
+
+	require.NoError(t, r.SetRules(nil))
+	require.Zero(t, r.Count())
+}
+
+// recordingT collects the failures Verify reports
+type recordingT struct {
+	errors []string
+}
+
+func (r *recordingT) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestExpect(t *testing.T) {
+	s, err := FromYAML(`
+rules:
+  - name: "api.test."
+    records:
+      A: ["api.test. 60 IN A 10.0.0.1"]
+      SRV: ["api.test. 60 IN SRV 0 0 80 web.test."]
+  - name: "unused.test."
+    records:
+      A: ["unused.test. 60 IN A 10.0.0.2"]
+  - name: "fallback.test."
+    optional: true
+    records:
+      A: ["fallback.test. 60 IN A 10.0.0.3"]
+`)
+	require.NoError(t, err)
+
+	api := s.Expect("api.test.", dns.TypeA)
+	srv := s.Expect("API.test.", dns.TypeSRV).Times(2)
+	prod := s.Expect("*.prod.", dns.TypeNone).Never()
+	web := s.Expect("web-?.test.", dns.TypeNone).AtMost(1)
+	s.Expect("missing.test.", dns.TypeA).AtLeast(2)
+
+	lookup := func(name string, qtype uint16) {
+		q := &dns.Msg{}
+		q.SetQuestion(name, qtype)
+		_, err := s.Find(q)
+		require.NoError(t, err)
+	}
+	lookup("api.test.", dns.TypeA)
+	lookup("api.test.", dns.TypeA)
+	lookup("api.test.", dns.TypeSRV)
+	lookup("db.eu.prod.", dns.TypeAAAA)
+	lookup("web-1.test.", dns.TypeA)
+	lookup("web-1.test.", dns.TypeMX)
+
+	require.Equal(t, 2, api.Count())
+	require.Equal(t, 1, srv.Count())
+	require.Equal(t, 1, prod.Count())
+	require.Equal(t, 2, web.Count())
+	require.Equal(t, uint64(3), s.Rules[0].Hits())
+	require.Zero(t, s.Rules[1].Hits())
+
+	rt := &recordingT{}
+	s.Verify(rt)
+	require.Equal(t, []string{
+		"expected SRV queries for api.test. exactly 2 times, got 1",
+		"expected queries for *.prod. never, got 1",
+		"expected queries for web-?.test. at most once, got 2",
+		"expected A queries for missing.test. at least 2 times, got 0",
+		`rule "unused.test." (line 7) was never hit`,
+	}, rt.errors)
+
+	// counts start over on reset
+	s.Reset()
+	require.Zero(t, api.Count())
+	require.Zero(t, s.Rules[0].Hits())
+	lookup("api.test.", dns.TypeSRV)
+	lookup("api.test.", dns.TypeSRV)
+	lookup("unused.test.", dns.TypeA)
+	lookup("missing.test.", dns.TypeA)
+	lookup("missing.test.", dns.TypeA)
+
+	rt = &recordingT{}
+	s.Verify(rt)
+	require.Equal(t, []string{
+		"expected A queries for api.test. at least once, got 0",
+	}, rt.errors)
+}
@@ -0,0 +1,144 @@
+package spec
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+	"text/template"
+
+	"github.com/miekg/dns"
+)
+
+// TemplateData is what record templates are executed against,
+// e.g. "{{.Name}} 300 IN A {{haship \"10.0.0.0/8\" .Name}}".
+//
+// Besides the usual text/template functions, templates can use:
+//
+//	Name            the query name, same as .Name
+//	label i         the i'th label of the query name, negative counts from the end
+//	lower s         s in lower case
+//	upper s         s in upper case
+//	haship cidr s   an address within cidr picked by hashing s, stable for a given s
+//	reverse ip      the PTR name for ip, e.g. 4.3.2.1.in-addr.arpa.
+//	group g         capture group g of a glob or regex rule, by number or name
+type TemplateData struct {
+	// Name is the query name
+	Name string
+	// Labels are the labels of the query name, e.g. ["www", "example", "com"]
+	Labels []string
+	// Type is the query type, e.g. "A"
+	Type string
+	// ClientIP is the address of the client, empty if not known
+	ClientIP string
+	// Groups are the whole match and capture groups of a glob
+	// or regex rule, taken from the lower cased query name
+	Groups []string
+	// names of the capture groups, for looking them up by name
+	groupNames []string
+}
+
+func newTemplateData(q Query) *TemplateData {
+	question := q.Msg.Question[0]
+
+	data := &TemplateData{
+		Name:   question.Name,
+		Labels: dns.SplitDomainName(question.Name),
+		Type:   dns.TypeToString[question.Qtype],
+	}
+	if q.ClientIP != nil {
+		data.ClientIP = q.ClientIP.String()
+	}
+	return data
+}
+
+// templateFuncs are the functions available to templates.  Those that
+// depend on the query are bound to it when the template is executed.
+func templateFuncs(data *TemplateData) template.FuncMap {
+	return template.FuncMap{
+		"Name": func() string {
+			return data.Name
+		},
+		"label": func(i int) string {
+			if i < 0 {
+				i += len(data.Labels)
+			}
+			if i < 0 || i >= len(data.Labels) {
+				return ""
+			}
+			return data.Labels[i]
+		},
+		"lower":   strings.ToLower,
+		"upper":   strings.ToUpper,
+		"haship":  hashIP,
+		"reverse": dns.ReverseAddr,
+		"group": func(g interface{}) (string, error) {
+			switch g := g.(type) {
+			case int:
+				if g >= 0 && g < len(data.Groups) {
+					return data.Groups[g], nil
+				}
+			case string:
+				for i, name := range data.groupNames {
+					if name == g && name != "" && i < len(data.Groups) {
+						return data.Groups[i], nil
+					}
+				}
+			}
+			return "", fmt.Errorf("no group %v", g)
+		},
+	}
+}
+
+func parseTemplate(val string) (*template.Template, error) {
+	return template.New("record").
+		Funcs(templateFuncs(&TemplateData{})).
+		Option("missingkey=error").
+		Parse(val)
+}
+
+func executeTemplate(t *template.Template, data *TemplateData) (string, error) {
+	t, err := t.Clone()
+	if err != nil {
+		return "", err
+	}
+
+	b := &bytes.Buffer{}
+	if err := t.Funcs(templateFuncs(data)).Execute(b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// hashIP picks an address within cidr by hashing s
+func hashIP(cidr string, s string) (string, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", err
+	}
+
+	ones, bits := network.Mask.Size()
+	hostBits := bits - ones
+
+	h := fnv.New64a()
+	h.Write([]byte(strings.ToLower(s)))
+	offset := h.Sum64()
+	if hostBits < 64 {
+		offset %= uint64(1) << hostBits
+	}
+
+	// the host part of the network address is all zeros,
+	// so the offset can be or-ed in from the end
+	ip := make(net.IP, len(network.IP))
+	copy(ip, network.IP)
+	for i := len(ip) - 1; i >= 0 && offset > 0; i-- {
+		ip[i] |= byte(offset)
+		offset >>= 8
+	}
+
+	if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+		return "", fmt.Errorf("bad network %q", cidr)
+	}
+	return ip.String(), nil
+}
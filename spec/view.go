@@ -0,0 +1,72 @@
+package spec
+
+import (
+	"fmt"
+	"net"
+)
+
+// networks parses CIDRs, or single IPs, found at path
+func (rc *ruleCompiler) networks(path string, vals []string) []*net.IPNet {
+	networks := []*net.IPNet{}
+	for i, val := range vals {
+		network, err := parseNetwork(val)
+		if err != nil {
+			rc.fail("", fmt.Sprintf("%s/%d", path, i), err)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func parseNetwork(val string) (*net.IPNet, error) {
+	if ip := net.ParseIP(val); ip != nil {
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(val)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR %q", val)
+	}
+	return network, nil
+}
+
+// sees is whether the rule applies to the client of a query,
+// as rules limited to some clients are like views in BIND
+func (c *compiledRule) sees(q Query) bool {
+	if len(c.clients) > 0 && !containsIP(c.clients, q.ClientIP) {
+		return false
+	}
+	if len(c.subnets) > 0 && (q.ClientSubnet == nil || !containsNetwork(c.subnets, q.ClientSubnet)) {
+		return false
+	}
+	return true
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsNetwork is whether subnet lies within one of the networks
+func containsNetwork(networks []*net.IPNet, subnet *net.IPNet) bool {
+	ones, _ := subnet.Mask.Size()
+	for _, network := range networks {
+		size, _ := network.Mask.Size()
+		if network.Contains(subnet.IP) && ones >= size {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,215 @@
+package spec
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// FromZone loads a spec from an RFC 1035 master file, e.g. a BIND zone
+// file, with a rule for each owner name in the order they first appear.
+// origin is used for relative names until the file sets $ORIGIN, and
+// filename is used in errors.
+func FromZone(r io.Reader, origin string, filename string) (*Responses, error) {
+	if origin == "" {
+		origin = "."
+	}
+	zp := dns.NewZoneParser(r, dns.Fqdn(origin), filename)
+
+	responses := New()
+	rules := map[string]*Rule{}
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		name := rr.Header().Name
+		rule := rules[name]
+		if rule == nil {
+			rule = &Rule{Name: name, Records: map[string][]string{}}
+			rules[name] = rule
+			responses.Rules = append(responses.Rules, rule)
+		}
+		qtype := dns.TypeToString[rr.Header().Rrtype]
+		rule.Records[qtype] = append(rule.Records[qtype], rr.String())
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := responses.Compile(); err != nil {
+		return nil, err
+	}
+	return responses, nil
+}
+
+// FromZoneFile loads a spec from a zone file
+func FromZoneFile(path string, origin string) (*Responses, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return FromZone(f, origin, path)
+}
+
+// WriteZone writes the records of the spec as an RFC 1035 master file,
+// with names relative to origin and the most used TTL as $TTL.  An empty
+// origin uses the name of the first SOA record, if there is one.
+//
+// Records in the authority and additional sections are written too,
+// so recorded SOA and glue records are kept, with duplicates left out.
+// Templates and glob or regex rules can't be written, so are left out
+// with a comment saying so.  Rcodes, flags and the other settings of
+// rules are left out too.
+func (r *Responses) WriteZone(w io.Writer, origin string) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	type line struct {
+		rr      dns.RR
+		comment string
+	}
+	lines := []line{}
+	ttls := map[uint32]int{}
+	written := map[string]bool{}
+
+	add := func(rule *Rule, qtype string, path string, vals []string) error {
+		for _, val := range vals {
+			if isTemplate(val) {
+				lines = append(lines, line{comment: fmt.Sprintf("skipped template %q", val)})
+				continue
+			}
+			rr, err := parseRecord(val)
+			if err != nil {
+				return &RecordError{Rule: rule.Name, Qtype: qtype, Line: rule.lineOf(path), Err: err}
+			}
+			if written[rr.String()] {
+				continue
+			}
+			written[rr.String()] = true
+			if origin == "" && rr.Header().Rrtype == dns.TypeSOA {
+				origin = rr.Header().Name
+			}
+			ttls[rr.Header().Ttl]++
+			lines = append(lines, line{rr: rr})
+		}
+		return nil
+	}
+
+	for _, rule := range r.Rules {
+		if rule.Match != "" && rule.Match != MatchExact {
+			lines = append(lines, line{comment: fmt.Sprintf("skipped %s rule %q", rule.Match, rule.Name)})
+			continue
+		}
+
+		types := []string{}
+		for qtype := range rule.Records {
+			types = append(types, qtype)
+		}
+		for _, qtype := range zoneTypes(types) {
+			if err := add(rule, qtype, join("records", qtype), rule.Records[qtype]); err != nil {
+				return err
+			}
+		}
+
+		// then the other sections, the rule's own before each type's
+		if err := add(rule, "", "authority", rule.Authority); err != nil {
+			return err
+		}
+		if err := add(rule, "", "additional", rule.Additional); err != nil {
+			return err
+		}
+		types = []string{}
+		for qtype := range rule.Types {
+			types = append(types, qtype)
+		}
+		for _, qtype := range zoneTypes(types) {
+			reply := rule.Types[qtype]
+			if reply == nil {
+				continue
+			}
+			path := join("types", qtype)
+			if err := add(rule, qtype, join(path, "authority"), reply.Authority); err != nil {
+				return err
+			}
+			if err := add(rule, qtype, join(path, "additional"), reply.Additional); err != nil {
+				return err
+			}
+		}
+	}
+
+	if origin == "" {
+		origin = "."
+	}
+	origin = dns.CanonicalName(origin)
+	ttl := defaultTTL(ttls)
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "$ORIGIN %s\n", origin)
+	fmt.Fprintf(bw, "$TTL %d\n", ttl)
+	for _, l := range lines {
+		if l.rr == nil {
+			fmt.Fprintf(bw, "; %s\n", l.comment)
+			continue
+		}
+		fmt.Fprintln(bw, zoneLine(l.rr, origin, ttl))
+	}
+	return bw.Flush()
+}
+
+// zoneTypes orders the types of records for a zone file, SOA then
+// NS first as is usual, then the rest by name
+func zoneTypes(types []string) []string {
+	rank := func(qtype string) int {
+		switch qtype {
+		case "SOA":
+			return 0
+		case "NS":
+			return 1
+		}
+		return 2
+	}
+
+	sort.Slice(types, func(i, j int) bool {
+		if rank(types[i]) != rank(types[j]) {
+			return rank(types[i]) < rank(types[j])
+		}
+		return types[i] < types[j]
+	})
+	return types
+}
+
+// defaultTTL is the most used TTL, the lowest if there's a tie
+func defaultTTL(ttls map[uint32]int) uint32 {
+	best, count := uint32(NegativeTTL), 0
+	for ttl, n := range ttls {
+		if n > count || (n == count && ttl < best) {
+			best, count = ttl, n
+		}
+	}
+	return best
+}
+
+// zoneLine formats a record with its name relative to origin,
+// leaving out the TTL if it is the default
+func zoneLine(rr dns.RR, origin string, ttl uint32) string {
+	hdr := rr.Header()
+	rdata := strings.TrimPrefix(rr.String(), hdr.String())
+
+	name := hdr.Name
+	switch canonical := dns.CanonicalName(name); {
+	case canonical == origin:
+		name = "@"
+	case origin != "." && strings.HasSuffix(canonical, "."+origin):
+		name = name[:len(name)-len(origin)-1]
+	}
+
+	class := dns.ClassToString[hdr.Class]
+	qtype := dns.TypeToString[hdr.Rrtype]
+	if hdr.Ttl == ttl {
+		return fmt.Sprintf("%s\t%s\t%s\t%s", name, class, qtype, rdata)
+	}
+	return fmt.Sprintf("%s\t%d\t%s\t%s\t%s", name, hdr.Ttl, class, qtype, rdata)
+}